@@ -0,0 +1,409 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A BackupNaming determines the names a FileLogWriter gives the files it
+// rotates out.
+type BackupNaming int
+
+const (
+	BackupSequence BackupNaming = iota // name.001, name.002, ... in the order they are made (the default)
+	BackupDate                         // name.2009-02-13, for the day the file was started
+	BackupDateTime                     // name.2009-02-13-233130, for the time the file was started
+	BackupShift                        // name.1 is always the newest, and older files are renumbered
+)
+
+var backupNamingStrings = [...]string{"sequence", "date", "datetime", "shift"}
+
+func (n BackupNaming) String() string {
+	if n < 0 || int(n) >= len(backupNamingStrings) {
+		return "unknown"
+	}
+	return backupNamingStrings[n]
+}
+
+// The layouts of the BackupDate and BackupDateTime extensions
+const (
+	backupDateLayout     = "2006-01-02"
+	backupDateTimeLayout = "2006-01-02-150405"
+)
+
+// A backupFile is a log file which a FileLogWriter has rotated out.
+type backupFile struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// A backupSet describes the files a FileLogWriter rotates out and the limits
+// on keeping them.  The maintenance done in the background works from a copy,
+// since the writing goroutine changes the file name as it goes.
+type backupSet struct {
+	filename     string // The current file
+	pattern      string // The pattern the file name is made from, if any
+	compression  Compression
+	maxbackups   int
+	maxage       time.Duration
+	maxtotalsize int64
+	shared       bool            // Other processes write to the same file
+	report       func(err error) // Handles errors, from any goroutine
+}
+
+// rotated returns the writer's backupSet as it stands.  It must only be
+// called by the writing goroutine, or before the first log message.
+func (w *FileLogWriter) rotated() backupSet {
+	return backupSet{
+		filename:     w.filename,
+		pattern:      w.pattern,
+		compression:  w.compression,
+		maxbackups:   w.maxbackups,
+		maxage:       w.maxage,
+		maxtotalsize: w.maxtotalsize,
+		shared:       w.shared,
+		report:       w.reportError,
+	}
+}
+
+// isBackupNumber reports whether ext is a BackupSequence extension.
+func isBackupNumber(ext string) bool {
+	if len(ext) < 3 {
+		return false
+	}
+	for i := 0; i < len(ext); i++ {
+		if ext[i] < '0' || ext[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isBackupExt reports whether ext (without the leading '.') is an extension
+// which intRotate gives a rotated file: a number, or a date or date and time
+// followed by an optional number to tell apart files from the same time.
+func isBackupExt(ext string) bool {
+	if _, err := strconv.ParseUint(ext, 10, 0); err == nil {
+		return true
+	}
+	if i := strings.IndexByte(ext, '.'); i >= 0 {
+		if _, err := strconv.Atoi(ext[i+1:]); err != nil {
+			return false
+		}
+		ext = ext[:i]
+	}
+	for _, layout := range []string{backupDateLayout, backupDateTimeLayout} {
+		if _, err := time.Parse(layout, ext); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// backupName returns the name to which to rotate the current file, which was
+// started at opened.  For BackupShift, it first makes way by renumbering the
+// existing files.
+func (w *FileLogWriter) backupName(opened time.Time) (string, error) {
+	switch w.naming {
+	case BackupShift:
+		return w.filename + ".1", w.shiftBackups()
+	case BackupDate, BackupDateTime:
+		layout := backupDateLayout
+		if w.naming == BackupDateTime {
+			layout = backupDateTimeLayout
+		}
+		base := w.filename + "." + opened.Format(layout)
+		fname := base
+		for n := 1; backupExists(fname); n++ {
+			fname = base + "." + strconv.Itoa(n)
+		}
+		return fname, nil
+	}
+
+	// Find the next available number
+	for num := 1; num <= 999; num++ {
+		fname := w.filename + fmt.Sprintf(".%03d", num)
+		if !backupExists(fname) {
+			return fname, nil
+		}
+	}
+
+	// If they are all taken, make room by removing the oldest if old files
+	// are being removed anyway, or return an error
+	if b := w.rotated(); b.retaining() {
+		w.maintaining.Wait()
+		backups := b.backups()
+		for i := len(backups) - 1; i >= 0; i-- {
+			fname := strings.TrimSuffix(backups[i].name, CompressGzip.ext())
+			if !strings.HasPrefix(fname, w.filename+".") || !isBackupNumber(fname[len(w.filename)+1:]) {
+				continue
+			}
+			if err := os.Remove(backups[i].name); err != nil {
+				return "", fmt.Errorf("Rotate: %s\n", err)
+			}
+			return fname, nil
+		}
+	}
+	return "", fmt.Errorf("Rotate: Cannot find free log number to rename %s\n", w.filename)
+}
+
+// shiftBackups renames name.1 to name.2, name.2 to name.3 and so on, removing
+// any which would be beyond the maximum number of backups.  Compression is
+// finished first, since it would otherwise race with the renaming.
+func (w *FileLogWriter) shiftBackups() error {
+	w.maintaining.Wait()
+
+	last := 0
+	for backupExists(w.filename + "." + strconv.Itoa(last+1)) {
+		last++
+	}
+	for n := last; n > 0; n-- {
+		from := w.filename + "." + strconv.Itoa(n)
+		to := w.filename + "." + strconv.Itoa(n+1)
+		for _, ext := range []string{"", CompressGzip.ext()} {
+			if _, err := os.Lstat(from + ext); err != nil {
+				continue
+			}
+			var err error
+			if w.maxbackups > 0 && n >= w.maxbackups {
+				err = os.Remove(from + ext)
+			} else {
+				err = os.Rename(from+ext, to+ext)
+			}
+			if err != nil {
+				return fmt.Errorf("Rotate: %s\n", err)
+			}
+		}
+	}
+	return nil
+}
+
+// backupExists reports whether a rotated file called name exists, compressed
+// or not.
+func backupExists(name string) bool {
+	if _, err := os.Lstat(name); err == nil {
+		return true
+	}
+	_, err := os.Lstat(name + CompressGzip.ext())
+	return err == nil
+}
+
+// backupGlobs returns the glob patterns which match the rotated files, and
+// files which are being compressed.  If the file name comes from a pattern,
+// the files from earlier periods count as rotated files.
+func (b backupSet) backupGlobs() []string {
+	if b.pattern == "" {
+		return []string{b.filename + ".*"}
+	}
+	glob := filenameGlob(b.pattern)
+	return []string{glob, glob + ".*"}
+}
+
+// isBackupBase reports whether name is the current file, or if the file name
+// comes from a pattern, the file from any period.
+func (b backupSet) isBackupBase(name string) bool {
+	if b.pattern == "" {
+		return name == b.filename
+	}
+	ok, _ := filepath.Match(filenameGlob(b.pattern), name)
+	return ok
+}
+
+// backups lists the rotated files, compressed or not, newest first.
+func (b backupSet) backups() []backupFile {
+	var files []backupFile
+	seen := make(map[string]bool)
+	for _, glob := range b.backupGlobs() {
+		matches, _ := filepath.Glob(glob)
+		for _, name := range matches {
+			if seen[name] || name == b.filename || strings.HasSuffix(name, compressTempExt) {
+				continue
+			}
+			seen[name] = true
+
+			rest := strings.TrimSuffix(name, CompressGzip.ext())
+			ok := rest != b.filename && b.pattern != "" && b.isBackupBase(rest)
+			for i := 0; !ok && i < len(rest); i++ {
+				ok = rest[i] == '.' && b.isBackupBase(rest[:i]) && isBackupExt(rest[i+1:])
+			}
+			if !ok {
+				continue
+			}
+
+			fi, err := os.Lstat(name)
+			if err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			files = append(files, backupFile{name, fi.Size(), fi.ModTime()})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].modTime.Equal(files[j].modTime) {
+			return files[i].modTime.After(files[j].modTime)
+		}
+		return files[i].name > files[j].name
+	})
+	return files
+}
+
+// retaining reports whether any retention limit is set.
+func (b backupSet) retaining() bool {
+	return b.maxbackups > 0 || b.maxage > 0 || b.maxtotalsize > 0
+}
+
+// retain removes the rotated files which are beyond the retention limits.  It
+// must only be called in the background.
+func (b backupSet) retain() {
+	if !b.retaining() {
+		return
+	}
+	var total int64
+	cutoff := time.Now().Add(-b.maxage)
+	for i, file := range b.backups() {
+		total += file.size
+		switch {
+		case b.maxbackups > 0 && i >= b.maxbackups:
+		case b.maxage > 0 && file.modTime.Before(cutoff):
+		case b.maxtotalsize > 0 && total > b.maxtotalsize:
+		default:
+			continue
+		}
+		if err := os.Remove(file.name); err != nil && !os.IsNotExist(err) {
+			b.report(fmt.Errorf("retain: %s", err))
+		}
+	}
+}
+
+// maintain compresses the rotated file name, if compression is on, and then
+// applies the retention limits, in the background.
+func (w *FileLogWriter) maintain(name string) {
+	b := w.rotated()
+	if b.compression == CompressNone && !b.retaining() {
+		return
+	}
+	w.background(func() {
+		if b.compression != CompressNone {
+			b.compress(name)
+		}
+		b.retain()
+	})
+}
+
+// background runs fn, which maintains the rotated files, in another goroutine.
+// Maintenance runs one fn at a time, and Close waits for it.
+func (w *FileLogWriter) background(fn func()) {
+	w.maintaining.Add(1)
+	go func() {
+		defer w.maintaining.Done()
+		w.maintenance.Lock()
+		defer w.maintenance.Unlock()
+		fn()
+	}()
+}
+
+// The filename pattern verbs, from the longest period to the shortest
+const filenameVerbs = "YmdHMS"
+
+// expandFilename replaces the verbs in a filename pattern with the parts of t:
+// %Y year, %m month, %d day, %H hour, %M minute, %S second and %% a literal %.
+// Anything else is left as it is.
+func expandFilename(pattern string, t time.Time) string {
+	var buf []byte
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i+1 == len(pattern) {
+			buf = append(buf, pattern[i])
+			continue
+		}
+		i++
+		switch pattern[i] {
+		case 'Y':
+			buf = appendZeroPadded(buf, t.Year(), 4)
+		case 'm':
+			buf = appendZeroPadded(buf, int(t.Month()), 2)
+		case 'd':
+			buf = appendZeroPadded(buf, t.Day(), 2)
+		case 'H':
+			buf = appendZeroPadded(buf, t.Hour(), 2)
+		case 'M':
+			buf = appendZeroPadded(buf, t.Minute(), 2)
+		case 'S':
+			buf = appendZeroPadded(buf, t.Second(), 2)
+		case '%':
+			buf = append(buf, '%')
+		default:
+			buf = append(buf, '%', pattern[i])
+		}
+	}
+	return string(buf)
+}
+
+// filenameGlob returns a glob pattern matching the names of every period of a
+// filename pattern.
+func filenameGlob(pattern string) string {
+	var buf []byte
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i+1 == len(pattern) {
+			buf = append(buf, pattern[i])
+			continue
+		}
+		i++
+		switch {
+		case strings.IndexByte(filenameVerbs, pattern[i]) >= 0:
+			if len(buf) == 0 || buf[len(buf)-1] != '*' {
+				buf = append(buf, '*')
+			}
+		case pattern[i] == '%':
+			buf = append(buf, '%')
+		default:
+			buf = append(buf, '%', pattern[i])
+		}
+	}
+	return string(buf)
+}
+
+// filenamePeriod returns the verb for the shortest period in a filename
+// pattern, or 0 if it has none.
+func filenamePeriod(pattern string) byte {
+	period := -1
+	for i := 0; i+1 < len(pattern); i++ {
+		if pattern[i] != '%' {
+			continue
+		}
+		i++
+		if p := strings.IndexByte(filenameVerbs, pattern[i]); p > period {
+			period = p
+		}
+	}
+	if period < 0 {
+		return 0
+	}
+	return filenameVerbs[period]
+}
+
+// nextPeriod returns the start of the period after the one containing t.  The
+// period is one of the filename verbs.
+func nextPeriod(t time.Time, period byte) time.Time {
+	y, mo, d := t.Date()
+	h, mi, s := t.Clock()
+	switch period {
+	case 'Y':
+		return time.Date(y+1, 1, 1, 0, 0, 0, 0, t.Location())
+	case 'm':
+		return time.Date(y, mo+1, 1, 0, 0, 0, 0, t.Location())
+	case 'd':
+		return time.Date(y, mo, d+1, 0, 0, 0, 0, t.Location())
+	case 'H':
+		return time.Date(y, mo, d, h+1, 0, 0, 0, t.Location())
+	case 'M':
+		return time.Date(y, mo, d, h, mi+1, 0, 0, t.Location())
+	}
+	return time.Date(y, mo, d, h, mi, s+1, 0, t.Location())
+}
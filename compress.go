@@ -0,0 +1,137 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A Compression is the format in which a FileLogWriter compresses the files it
+// has rotated out.  Only gzip is supported, since the standard library has no
+// zstd encoder.
+type Compression int
+
+const (
+	CompressNone Compression = iota // Leave rotated files as they are (the default)
+	CompressGzip                    // Compress rotated files with gzip, adding .gz
+)
+
+var compressionStrings = [...]string{"none", "gzip"}
+
+func (c Compression) String() string {
+	if c < 0 || int(c) >= len(compressionStrings) {
+		return "unknown"
+	}
+	return compressionStrings[c]
+}
+
+// ext returns the extension added to compressed files.
+func (c Compression) ext() string {
+	if c == CompressGzip {
+		return ".gz"
+	}
+	return ""
+}
+
+// The extension of a file which is being compressed.  It is only renamed to
+// its final name once it is complete, so a file with this extension is left
+// over from a process which died while compressing, and can be removed.
+const compressTempExt = ".tmp"
+
+// When other processes share the file, a file being compressed may be one of
+// theirs, so it is only taken to be left over once it has not been written for
+// this long.
+const compressTempStale = time.Minute
+
+// compressFile compresses name to name plus the compression's extension, and
+// removes name once that is safely on disk.
+func compressFile(name string, c Compression) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	dest := name + c.ext()
+	tmp := dest + compressTempExt
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	gz.Name = filepath.Base(name)
+	gz.ModTime = fi.ModTime()
+	if _, err = io.Copy(gz, in); err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// Keep the time of the last record, which retention goes by
+	os.Chtimes(dest, fi.ModTime(), fi.ModTime())
+	return os.Remove(name)
+}
+
+// compress compresses the rotated file name, reporting any error.  It must
+// only be called in the background.
+func (b backupSet) compress(name string) {
+	if err := compressFile(name, b.compression); err != nil {
+		b.report(fmt.Errorf("compress: %s", err))
+	}
+}
+
+// recoverCompression finds what a previous process may have left undone: it
+// removes partially compressed files and rotated files whose compressed copy
+// was completed, and returns any others, which are still to be compressed.
+// Files which another process sharing the file is still compressing are left
+// to it.
+func (b backupSet) recoverCompression() (uncompressed []string) {
+	compressing := make(map[string]bool)
+	for _, glob := range b.backupGlobs() {
+		matches, _ := filepath.Glob(glob + compressTempExt)
+		for _, name := range matches {
+			if fi, err := os.Lstat(name); b.shared && err == nil && time.Since(fi.ModTime()) < compressTempStale {
+				compressing[strings.TrimSuffix(name, b.compression.ext()+compressTempExt)] = true
+				continue
+			}
+			os.Remove(name)
+		}
+	}
+
+	backups := b.backups()
+	compressed := make(map[string]bool, len(backups))
+	for _, file := range backups {
+		compressed[file.name] = true
+	}
+	for _, file := range backups {
+		switch {
+		case strings.HasSuffix(file.name, b.compression.ext()):
+		case compressed[file.name+b.compression.ext()]:
+			os.Remove(file.name)
+		case compressing[file.name]:
+		default:
+			uncompressed = append(uncompressed, file.name)
+		}
+	}
+	return uncompressed
+}
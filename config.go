@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 	"io/ioutil"
+	"time"
 )
 
 type LogConfig struct {
@@ -23,21 +24,21 @@ type LogConfig struct {
 }
 
 func NewLoggerFromLogger(original Logger, prefix string) (copy Logger) {
-	copy = make(Logger)
-	for filter_name, filter := range original {
-		copy.AddFilter(filter_name, filter.Level, NewConsoleLogWriter())
+	copy = NewLogger()
+	for filter_name, filter := range original.Filters() {
 		if filter_name == "stdout" {
-			copy[filter_name].Prefix = prefix
+			copy.addFilter(filter_name, &Filter{filter.Level, prefix, NewConsoleLogWriter()})
+			continue
 		}
+		copy.AddFilter(filter_name, filter.Level, NewConsoleLogWriter())
 	}
 	return
 }
 
 func NewLoggerFromConfig(logConfig *LogConfig, prefix string) (logger Logger) {
-	logger = make(Logger)
+	logger = NewLogger()
 	if logConfig.ConsoleLogLevel > 0 {
-		logger.AddFilter("stdout", LogLevel(logConfig.ConsoleLogLevel), NewConsoleLogWriter())
-		logger["stdout"].Prefix = prefix
+		logger.addFilter("stdout", &Filter{LogLevel(logConfig.ConsoleLogLevel), prefix, NewConsoleLogWriter()})
 	}
 
 	if logConfig.FileLogLevel > 0 {
@@ -55,20 +56,20 @@ func NewLoggerFromConfig(logConfig *LogConfig, prefix string) (logger Logger) {
 }
 
 type xmlProperty struct {
-	Name  string `xml:"attr"`
-	Value string `xml:"chardata"`
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
 }
 
 type xmlFilter struct {
-	Enabled  string `xml:"attr"`
-	Tag      string
-	Level    string
-	Type     string
-	Property []xmlProperty
+	Enabled  string        `xml:"enabled,attr"`
+	Tag      string        `xml:"tag"`
+	Level    string        `xml:"level"`
+	Type     string        `xml:"type"`
+	Property []xmlProperty `xml:"property"`
 }
 
 type xmlLoggerConfig struct {
-	Filter []xmlFilter
+	Filter []xmlFilter `xml:"filter"`
 }
 
 // Load XML configuration; see examples/example.xml for documentation
@@ -166,14 +167,80 @@ func (log Logger) LoadConfiguration(filename string) {
 		if !enabled {
 			continue
 		}
-		log[xmlfilt.Tag] = &Filter{lvl, "", filt}
+		log.AddFilter(xmlfilt.Tag, lvl, filt)
+	}
+}
+
+// xmlToFormatter returns the Formatter for a "format" property, which is
+// either "json", "logfmt" or a FormatLogRecord pattern, with times in loc (nil
+// for the zone of each record).
+func xmlToFormatter(format string, loc *time.Location) Formatter {
+	switch format {
+	case "json":
+		return JSONFormatter{Location: loc}
+	case "logfmt":
+		return LogfmtFormatter{Location: loc}
+	}
+	return CompileFormat(format).SetLocation(loc)
+}
+
+// xmlToLocation parses a "timezone" property: "UTC", "Local" or an IANA zone
+// name such as "America/New_York".
+func xmlToLocation(filename, filter, zone string) (*time.Location, bool) {
+	switch strings.ToLower(zone) {
+	case "utc":
+		return time.UTC, true
+	case "local":
+		return time.Local, true
 	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid timezone \"%s\" for %s filter in %s: %s\n", zone, filter, filename, err)
+		return nil, false
+	}
+	return loc, true
 }
 
-func xmlToConsoleLogWriter(filename string, props []xmlProperty, enabled bool) (ConsoleLogWriter, bool) {
+func xmlToConsoleLogWriter(filename string, props []xmlProperty, enabled bool) (*ConsoleLogWriter, bool) {
+	format := ""
+	color := ColorAuto
+	errLevel := INGORE
+	var loc *time.Location
+
 	// Parse properties
 	for _, prop := range props {
 		switch prop.Name {
+		case "format":
+			format = strings.Trim(prop.Value, " \r\n")
+		case "color":
+			switch value := strings.Trim(prop.Value, " \r\n"); value {
+			case "auto":
+				color = ColorAuto
+			case "always", "true":
+				color = ColorAlways
+			case "never", "false":
+				color = ColorNever
+			default:
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid color \"%s\" for console filter in %s: want auto, always or never\n", value, filename)
+				return nil, false
+			}
+		case "stderr":
+			if strings.Trim(prop.Value, " \r\n") != "false" {
+				errLevel = WARNING
+			} else {
+				errLevel = INGORE
+			}
+		case "stderrlevel":
+			value := strings.Trim(prop.Value, " \r\n")
+			if errLevel = LogLevel(LevelStringToLevel(value)); errLevel == INGORE {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid stderrlevel \"%s\" for console filter in %s\n", value, filename)
+				return nil, false
+			}
+		case "timezone":
+			var ok bool
+			if loc, ok = xmlToLocation(filename, "console", strings.Trim(prop.Value, " \r\n")); !ok {
+				return nil, false
+			}
 		default:
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for console filter in %s\n", prop.Name, filename)
 		}
@@ -184,7 +251,41 @@ func xmlToConsoleLogWriter(filename string, props []xmlProperty, enabled bool) (
 		return nil, true
 	}
 
-	return NewConsoleLogWriter(), true
+	clw := NewConsoleLogWriter().SetColor(color).SetStderrLevel(errLevel)
+	if len(format) > 0 {
+		clw.SetFormatter(xmlToFormatter(format, loc))
+	} else if loc != nil {
+		clw.SetFormatter(consoleFormatter{location: loc})
+	}
+	return clw, true
+}
+
+// xmlToBackupNaming parses a "backupnaming" property, or the name given as a
+// "rotate" property.
+func xmlToBackupNaming(filename, value string) (BackupNaming, bool) {
+	for naming, name := range backupNamingStrings {
+		if value == name {
+			return BackupNaming(naming), true
+		}
+	}
+	fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid backupnaming \"%s\" for file filter in %s: want sequence, date, datetime or shift\n", value, filename)
+	return BackupSequence, false
+}
+
+// xmlToDuration parses a duration property, such as "36h" or "7d".  Besides
+// the units understood by time.ParseDuration, it accepts d for days.
+func xmlToDuration(filename, prop, value string) (time.Duration, bool) {
+	if strings.HasSuffix(value, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil {
+			return time.Duration(days) * 24 * time.Hour, true
+		}
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid %s \"%s\" for file filter in %s: %s\n", prop, value, filename, err)
+		return 0, false
+	}
+	return d, true
 }
 
 // Parse a number with K/M/G suffixes based on thousands (1000) or 2^10 (1024)
@@ -210,46 +311,216 @@ func xmlToFileLogWriter(filename string, props []xmlProperty, enabled bool) (*Fi
 	file := ""
 	format := "[%D %T] [%L] (%S) %M"
 	maxlines := 0
+	countlines := false
 	maxsize := 0
 	daily := false
 	rotate := false
+	pattern := ""
+	var signals []os.Signal
+	reopen := false
+	var reopenCheck time.Duration
+	hourly := false
+	var interval time.Duration
+	naming := BackupSequence
+	compression := CompressNone
+	maxbackups := 0
+	var maxage time.Duration
+	var maxtotalsize int64
+	multiprocess := false
+	symlink := ""
+	bufsize := 0
+	var flushInterval, syncInterval time.Duration
+	syncPolicy := SyncNever
+	syncLevel := ERROR
+	var loc *time.Location
 
 	// Parse properties
 	for _, prop := range props {
 		switch prop.Name {
 		case "filename":
 			file = strings.Trim(prop.Value, " \r\n")
+		case "pattern":
+			pattern = strings.Trim(prop.Value, " \r\n")
 		case "format":
 			format = strings.Trim(prop.Value, " \r\n")
+		case "timezone":
+			var ok bool
+			if loc, ok = xmlToLocation(filename, "file", strings.Trim(prop.Value, " \r\n")); !ok {
+				return nil, false
+			}
 		case "maxlines":
 			maxlines = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1000)
+		case "countlines":
+			countlines = strings.Trim(prop.Value, " \r\n") != "false"
 		case "maxsize":
 			maxsize = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1024)
 		case "daily":
 			daily = strings.Trim(prop.Value, " \r\n") != "false"
+		case "reopensignal":
+			// Either true or false, or the name of the signal
+			switch value := strings.Trim(prop.Value, " \r\n"); value {
+			case "false":
+				reopen = false
+			case "true":
+				reopen = true
+			default:
+				sig, ok := signalNames[strings.ToUpper(value)]
+				if !ok {
+					fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown reopensignal \"%s\" for file filter in %s\n", value, filename)
+					return nil, false
+				}
+				reopen = true
+				signals = append(signals, sig)
+			}
+		case "reopenonmove":
+			// Either true or false, or how often to check
+			switch value := strings.Trim(prop.Value, " \r\n"); value {
+			case "false":
+				reopenCheck = 0
+			case "true":
+				reopenCheck = time.Second
+			default:
+				var ok bool
+				if reopenCheck, ok = xmlToDuration(filename, "reopenonmove", value); !ok {
+					return nil, false
+				}
+			}
+		case "bufsize":
+			bufsize = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1024)
+		case "flushinterval":
+			var ok bool
+			if flushInterval, ok = xmlToDuration(filename, "flushinterval", strings.Trim(prop.Value, " \r\n")); !ok {
+				return nil, false
+			}
+		case "sync":
+			switch value := strings.Trim(prop.Value, " \r\n"); value {
+			case "never", "false":
+				syncPolicy = SyncNever
+			case "record", "true":
+				syncPolicy = SyncEachRecord
+			case "interval":
+				syncPolicy = SyncInterval
+			case "level":
+				syncPolicy = SyncLevel
+			default:
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid sync \"%s\" for file filter in %s: want never, record, interval or level\n", value, filename)
+				return nil, false
+			}
+		case "syncinterval":
+			var ok bool
+			if syncInterval, ok = xmlToDuration(filename, "syncinterval", strings.Trim(prop.Value, " \r\n")); !ok {
+				return nil, false
+			}
+		case "synclevel":
+			value := strings.Trim(prop.Value, " \r\n")
+			if syncLevel = LogLevel(LevelStringToLevel(value)); syncLevel == INGORE {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid synclevel \"%s\" for file filter in %s\n", value, filename)
+				return nil, false
+			}
+		case "symlink":
+			symlink = strings.Trim(prop.Value, " \r\n")
+		case "multiprocess":
+			multiprocess = strings.Trim(prop.Value, " \r\n") != "false"
+		case "hourly":
+			hourly = strings.Trim(prop.Value, " \r\n") != "false"
+		case "interval":
+			var ok bool
+			if interval, ok = xmlToDuration(filename, "interval", strings.Trim(prop.Value, " \r\n")); !ok {
+				return nil, false
+			}
 		case "rotate":
-			rotate = strings.Trim(prop.Value, " \r\n") != "false"
+			// Either true or false, or how to name the rotated files
+			switch value := strings.Trim(prop.Value, " \r\n"); value {
+			case "false":
+				rotate = false
+			case "sequence", "date", "datetime", "shift":
+				rotate = true
+				naming, _ = xmlToBackupNaming(filename, value)
+			default:
+				rotate = true
+			}
+		case "backupnaming":
+			var ok bool
+			if naming, ok = xmlToBackupNaming(filename, strings.Trim(prop.Value, " \r\n")); !ok {
+				return nil, false
+			}
+		case "maxbackups":
+			value := strings.Trim(prop.Value, " \r\n")
+			var err error
+			if maxbackups, err = strconv.Atoi(value); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid maxbackups \"%s\" for file filter in %s: %s\n", value, filename, err)
+				return nil, false
+			}
+		case "maxage":
+			var ok bool
+			if maxage, ok = xmlToDuration(filename, "maxage", strings.Trim(prop.Value, " \r\n")); !ok {
+				return nil, false
+			}
+		case "maxtotalsize":
+			maxtotalsize = int64(strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1024))
+		case "compress":
+			switch value := strings.Trim(prop.Value, " \r\n"); value {
+			case "gzip", "true":
+				compression = CompressGzip
+			case "none", "false":
+				compression = CompressNone
+			case "zstd":
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: zstd compression for file filter in %s is not supported; use gzip\n", filename)
+				return nil, false
+			default:
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid compress \"%s\" for file filter in %s: want gzip or none\n", value, filename)
+				return nil, false
+			}
 		default:
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for file filter in %s\n", prop.Name, filename)
 		}
 	}
 
 	// Check properties
-	if len(file) == 0 {
+	if len(file) == 0 && len(pattern) == 0 {
 		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for file filter missing in %s\n", "filename", filename)
 		return nil, false
 	}
+	if len(file) > 0 && len(pattern) > 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Properties \"filename\" and \"pattern\" for file filter are exclusive in %s\n", filename)
+		return nil, false
+	}
 
 	// If it's disabled, we're just checking syntax
 	if !enabled {
 		return nil, true
 	}
 
-	flw := NewFileLogWriter(file, rotate)
-	flw.SetFormat(format)
+	var flw *FileLogWriter
+	if len(pattern) > 0 {
+		flw = NewPatternFileLogWriter(pattern, rotate)
+	} else {
+		flw = NewFileLogWriter(file, rotate)
+	}
+	flw.SetFormatter(xmlToFormatter(format, loc))
 	flw.SetRotateLines(maxlines)
+	flw.SetCountExistingLines(countlines)
 	flw.SetRotateSize(maxsize)
 	flw.SetRotateDaily(daily)
+	flw.SetRotateHourly(hourly)
+	flw.SetRotateInterval(interval)
+	flw.SetBackupNaming(naming)
+	flw.SetReopenOnMove(reopenCheck)
+	flw.SetMultiProcess(multiprocess)
+	flw.SetSymlink(symlink)
+	if bufsize > 0 {
+		flw.SetBuffer(bufsize, flushInterval)
+	}
+	flw.SetSyncPolicy(syncPolicy)
+	flw.SetSyncInterval(syncInterval)
+	flw.SetSyncLevel(syncLevel)
+	if reopen {
+		flw.ReopenOnSignal(signals...)
+	}
+	flw.SetCompress(compression)
+	flw.SetMaxBackups(maxbackups)
+	flw.SetMaxAge(maxage)
+	flw.SetMaxTotalSize(maxtotalsize)
 	return flw, true
 }
 
@@ -296,9 +567,11 @@ func xmlToXMLLogWriter(filename string, props []xmlProperty, enabled bool) (*Fil
 	return xlw, true
 }
 
-func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (SocketLogWriter, bool) {
+func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (*SocketLogWriter, bool) {
 	endpoint := ""
 	protocol := "udp"
+	format := ""
+	var loc *time.Location
 
 	// Parse properties
 	for _, prop := range props {
@@ -307,6 +580,13 @@ func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (S
 			endpoint = strings.Trim(prop.Value, " \r\n")
 		case "protocol":
 			protocol = strings.Trim(prop.Value, " \r\n")
+		case "format":
+			format = strings.Trim(prop.Value, " \r\n")
+		case "timezone":
+			var ok bool
+			if loc, ok = xmlToLocation(filename, "socket", strings.Trim(prop.Value, " \r\n")); !ok {
+				return nil, false
+			}
 		default:
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for file filter in %s\n", prop.Name, filename)
 		}
@@ -323,5 +603,9 @@ func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (S
 		return nil, true
 	}
 
-	return NewSocketLogWriter(protocol, endpoint), true
+	slw := NewSocketLogWriter(protocol, endpoint)
+	if len(format) > 0 {
+		slw.SetFormatter(xmlToFormatter(format, loc))
+	}
+	return slw, true
 }
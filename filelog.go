@@ -3,22 +3,70 @@
 package log4go
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
+// A SyncPolicy determines when a FileLogWriter commits its file to stable
+// storage, so that records survive a crash of the machine.
+type SyncPolicy int
+
+const (
+	SyncNever      SyncPolicy = iota // Leave it to the operating system (the default)
+	SyncEachRecord                   // After every record
+	SyncInterval                     // Once per sync interval, if anything was written
+	SyncLevel                        // After each record at the sync level or more severe
+)
+
+var syncPolicyStrings = [...]string{"never", "record", "interval", "level"}
+
+func (p SyncPolicy) String() string {
+	if p < 0 || int(p) >= len(syncPolicyStrings) {
+		return "unknown"
+	}
+	return syncPolicyStrings[p]
+}
+
 // This log writer sends output to a file
 type FileLogWriter struct {
-	rec chan *LogRecord
-	rot chan bool
+	*logQueue
 
 	// The opened file
 	filename string
 	file     *os.File
 
+	// The pattern from which filename is made, if it changes with the time
+	pattern string
+
 	// The logging format
-	format string
+	formatter Formatter
+	buf       []byte
+
+	// Buffer up to bufsize bytes of records, writing them out at least once
+	// per flushInterval.  What could not be written stays in pending.
+	bufsize       int
+	flushInterval time.Duration
+	pending       []byte
+
+	// When to sync the file, and whether anything was written since
+	syncPolicy   SyncPolicy
+	syncInterval time.Duration
+	syncLevel    LogLevel
+	unsynced     bool
+
+	// Whether the timers for buffering and syncing have been started
+	ticking bool
+
+	// Whether what earlier processes left undone has been looked for
+	recovered bool
 
 	// File header/trailer
 	header, trailer string
@@ -26,34 +74,74 @@ type FileLogWriter struct {
 	// Rotate at linecount
 	maxlines          int
 	maxlines_curlines int
+	countlines        bool // Count the lines already in a file when opening it
 
 	// Rotate at size
 	maxsize         int
 	maxsize_cursize int
 
-	// Rotate daily
-	daily          bool
-	daily_opendate int
+	// Rotate daily, hourly or at the end of each interval
+	daily    bool
+	hourly   bool
+	interval time.Duration
+
+	// When the file was opened, and when it must next be rotated (or zero)
+	opened, rotateAt time.Time
+
+	// How old logfiles are named
+	naming BackupNaming
+
+	// How often to check whether the file has been moved, and when next
+	reopenCheck time.Duration
+	reopenAt    time.Time
+
+	// Other processes write to the same file
+	shared bool
+
+	// A symlink kept pointing at the current file
+	symlink string
 
 	// Keep old logfiles (.001, .002, etc)
 	rotate bool
+
+	// Compress old logfiles in the background
+	compression Compression
+
+	// Remove old logfiles beyond these limits
+	maxbackups   int
+	maxage       time.Duration
+	maxtotalsize int64
+
+	// Background compression and retention
+	maintaining sync.WaitGroup
+	maintenance sync.Mutex
 }
 
-// This is the FileLogWriter's output method
+// This is the FileLogWriter's output method.  If the output buffer is full,
+// this blocks or not according to the overflow policy.
 func (w *FileLogWriter) LogWrite(rec *LogRecord) {
-	w.rec <- rec
+	w.put(rec)
 }
 
+// Close stops the writer and returns once the records already sent have been
+// written and the file has been closed.
 func (w *FileLogWriter) Close() {
-	close(w.rec)
+	w.close()
 }
 
 // NewFileLogWriter creates a new LogWriter which writes to the given file and
 // has rotation enabled if rotate is true.
 //
-// If rotate is true, any time a new log file is opened, the old one is renamed
-// with a .### extension to preserve it.  The various Set* methods can be used
-// to configure log rotation based on lines, size, and daily.
+// If rotate is true, any time the file is rotated, it is renamed with a .###
+// extension to preserve it.  The various Set* methods can be used to
+// configure log rotation based on lines, size, and daily, and to limit how
+// many old files are kept.  When such a limit is set and all of .001 to .999
+// are in use, the oldest file is removed instead of rotation failing.  An
+// existing file is appended to, and counts towards the limits with its size
+// and the time it was last written, so they hold across restarts.
+//
+// If the file cannot be opened, the error is printed on standard error, and
+// the writer tries again for each record, handling errors as any write error.
 //
 // The standard log-line format is:
 //   [%D %T] [%L] (%S) %M
@@ -61,92 +149,269 @@ func NewFileLogWriter(fname string, rotate bool) *FileLogWriter {
 	if fname == "" {
 		panic("No file name specified")
 	}
+	return newFileLogWriter(fname, "", rotate)
+}
+
+// NewPatternFileLogWriter creates a FileLogWriter like NewFileLogWriter, except
+// that the file name is made from a pattern containing the current time, such
+// as "app-%Y%m%d-%H.log".  The pattern may contain %Y (year), %m (month), %d
+// (day), %H (hour), %M (minute), %S (second) and %% (a literal %).  A new file
+// is started whenever the name changes, and the files from earlier periods
+// count as rotated files for compression and retention.
+func NewPatternFileLogWriter(pattern string, rotate bool) *FileLogWriter {
+	if pattern == "" {
+		panic("No file name pattern specified")
+	}
+	return newFileLogWriter(expandFilename(pattern, time.Now()), pattern, rotate)
+}
+
+func newFileLogWriter(fname, pattern string, rotate bool) *FileLogWriter {
 	w := &FileLogWriter{
-		rec:      make(chan *LogRecord, LogBufferLength),
-		rot:      make(chan bool),
-		filename: fname,
-		format:   "[%D %T] [%L] (%S) %M",
-		rotate:   rotate,
+		logQueue:     newLogQueue(),
+		filename:     fname,
+		pattern:      pattern,
+		formatter:    CompileFormat("[%D %T] [%L] (%S) %M"),
+		rotate:       rotate,
+		syncInterval: time.Second,
+		syncLevel:    ERROR,
 	}
 
-	// open the file for the first time
-	if err := w.intRotate(); err != nil {
-		fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-		return nil
+	// open the file for the first time; if that fails, the first write tries
+	// again, and handles the error
+	if err := w.open(time.Now()); err != nil {
+		fmt.Fprintf(stderr, "FileLogWriter(%q): %s\n", w.filename, err)
 	}
 
-	go func() {
-		defer func() {
-			if w.file != nil {
-				fmt.Fprint(w.file, FormatLogRecord(w.trailer, &LogRecord{Created: time.Now()}))
-				w.file.Close()
-			}
-		}()
+	w.start(fmt.Sprintf("FileLogWriter(%q)", w.filename), w.write, w.sync, w.finish)
+	return w
+}
 
-		for {
-			select {
-			case <-w.rot:
-				if err := w.intRotate(); err != nil {
-					fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-					return
-				}
-			case rec, ok := <-w.rec:
-				if !ok {
-					return
-				}
-				if (w.maxlines > 0 && w.maxlines_curlines >= w.maxlines) ||
-					(w.maxsize > 0 && w.maxsize_cursize >= w.maxsize) ||
-					(w.daily && time.Now().Day() != w.daily_opendate) {
-					if err := w.intRotate(); err != nil {
-						fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-						return
-					}
+// write formats rec into the file, rotating first if necessary.  It must only
+// be called by the writing goroutine.
+func (w *FileLogWriter) write(rec *LogRecord) error {
+	w.recover()
+	if w.file == nil {
+		if err := w.open(time.Now()); err != nil {
+			return err
+		}
+	}
+	if w.shared {
+		if err := w.follow(); err != nil {
+			return err
+		}
+	} else if w.reopenCheck > 0 {
+		if now := time.Now(); !now.Before(w.reopenAt) {
+			w.reopenAt = now.Add(w.reopenCheck)
+			if w.moved() {
+				if err := w.intReopen(); err != nil {
+					return err
 				}
+			}
+		}
+	}
+	if (w.maxlines > 0 && w.maxlines_curlines >= w.maxlines) ||
+		(w.maxsize > 0 && w.maxsize_cursize >= w.maxsize) ||
+		(!w.rotateAt.IsZero() && !time.Now().Before(w.rotateAt)) {
+		if err := w.lockedRotate(); err != nil {
+			return err
+		}
+	}
 
-				// Perform the write
-				n, err := fmt.Fprint(w.file, FormatLogRecord(w.format, rec))
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-					return
-				}
+	if !w.ticking {
+		w.ticking = true
+		w.startTimers()
+	}
+
+	// Perform the write, unless this is a retry of a record which was
+	// written but not synced
+	syncNow := w.syncPolicy == SyncEachRecord || (w.syncPolicy == SyncLevel && rec.Level <= w.syncLevel)
+	if !w.written {
+		w.buf = w.formatter.Format(w.buf[:0], rec)
+		n, err := w.output(w.buf, syncNow)
+		if err != nil {
+			return err
+		}
+
+		// Update the counts
+		w.maxlines_curlines++
+		w.maxsize_cursize += n
+		w.unsynced = true
+	}
+
+	if syncNow {
+		if err := w.sync(); err != nil {
+			w.written = true
+			return err
+		}
+	}
+	return nil
+}
 
-				// Update the counts
-				w.maxlines_curlines++
-				w.maxsize_cursize += n
+// output writes p to the file, through the buffer if there is one.  The
+// buffer is written out first if p would overflow it, or if p is to be synced
+// straight away, in which case p is written directly.  If the buffer cannot
+// be written out, none of p is written.
+func (w *FileLogWriter) output(p []byte, syncNow bool) (int, error) {
+	if w.bufsize <= 0 {
+		return w.file.Write(p)
+	}
+	if syncNow || len(w.pending)+len(p) > w.bufsize {
+		if err := w.flushBuffer(); err != nil {
+			return 0, err
+		}
+	}
+	if syncNow || len(p) >= w.bufsize {
+		return w.file.Write(p)
+	}
+	w.pending = append(w.pending, p...)
+	return len(p), nil
+}
+
+// startTimers starts a goroutine which has the writing goroutine write out
+// the buffer and sync the file at their intervals, until the writer is
+// closed.
+func (w *FileLogWriter) startTimers() {
+	var flush, sync <-chan time.Time
+	var tickers []*time.Ticker
+	if w.bufsize > 0 {
+		ticker := time.NewTicker(w.flushInterval)
+		tickers = append(tickers, ticker)
+		flush = ticker.C
+	}
+	if w.syncPolicy == SyncInterval {
+		ticker := time.NewTicker(w.syncInterval)
+		tickers = append(tickers, ticker)
+		sync = ticker.C
+	}
+	if len(tickers) == 0 {
+		return
+	}
+
+	go func() {
+		for _, ticker := range tickers {
+			defer ticker.Stop()
+		}
+		for {
+			select {
+			case <-flush:
+				w.control(context.Background(), w.flushBuffer)
+			case <-sync:
+				w.control(context.Background(), w.syncWritten)
+			case <-w.done:
+				return
 			}
 		}
 	}()
+}
 
-	return w
+// flushBuffer writes out the buffered records.  Whatever could not be written
+// stays buffered, to be tried again.
+func (w *FileLogWriter) flushBuffer() error {
+	if len(w.pending) == 0 || w.file == nil {
+		return nil
+	}
+	n, err := w.file.Write(w.pending)
+	w.pending = w.pending[:copy(w.pending, w.pending[n:])]
+	return err
+}
+
+// syncWritten syncs the file if anything was written since it was last
+// synced.
+func (w *FileLogWriter) syncWritten() error {
+	if !w.unsynced || w.file == nil {
+		return nil
+	}
+	return w.sync()
+}
+
+// sync writes out the buffered records and commits the current file to
+// stable storage.
+func (w *FileLogWriter) sync() error {
+	if w.file == nil {
+		return errNoFile
+	}
+	if err := w.flushBuffer(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.unsynced = false
+	return nil
+}
+
+// closeFile writes out the buffered records, and the trailer if wanted, and
+// closes the file.  Unless the sync policy is SyncNever, the file is synced
+// first.  Buffered records which cannot be written go to standard error
+// rather than being lost.
+func (w *FileLogWriter) closeFile(trailer bool) {
+	if err := w.flushBuffer(); err != nil {
+		w.reportError(err)
+		stderr.Write(w.pending)
+		w.pending = w.pending[:0]
+	}
+	if trailer {
+		fmt.Fprint(w.file, FormatLogRecord(w.trailer, &LogRecord{Created: time.Now()}))
+	}
+	if w.syncPolicy != SyncNever {
+		w.file.Sync()
+	}
+	w.file.Close()
+	w.file = nil
+}
+
+var errNoFile = errors.New("log4go: no log file is open")
+
+// finish writes the trailer and closes the file once the writer is closed.
+func (w *FileLogWriter) finish() {
+	if w.file != nil {
+		w.closeFile(true)
+	}
+	w.maintaining.Wait()
 }
 
-// Request that the logs rotate
+// Request that the logs rotate once the records already sent are written
 func (w *FileLogWriter) Rotate() {
-	w.rot <- true
+	w.control(context.Background(), w.lockedRotate)
+}
+
+// Flush waits until the records already sent have been written to the file
+// and the file has been synced to stable storage, or ctx is done.
+func (w *FileLogWriter) Flush(ctx context.Context) error {
+	return w.flush(ctx)
 }
 
 // If this is called in a threaded context, it MUST be synchronized
 func (w *FileLogWriter) intRotate() error {
+	w.recover()
+
 	// Close any log file that may be open
+	previous := ""
 	if w.file != nil {
-		fmt.Fprint(w.file, FormatLogRecord(w.trailer, &LogRecord{Created: time.Now()}))
-		w.file.Close()
+		w.closeFile(true)
+		previous = w.filename
 	}
 
-	// If we are keeping log files, move it to the next available number
+	// A file from an earlier period keeps its name
+	now := time.Now()
+	if w.pattern != "" {
+		w.filename = expandFilename(w.pattern, now)
+	}
+	if previous != "" && previous != w.filename {
+		w.maintain(previous)
+	}
+
+	// If we are keeping log files, move it out of the way
 	if w.rotate {
-		_, err := os.Lstat(w.filename)
+		fi, err := os.Lstat(w.filename)
 		if err == nil { // file exists
-			// Find the next available number
-			num := 1
-			fname := ""
-			for ; err == nil && num <= 999; num++ {
-				fname = w.filename + fmt.Sprintf(".%03d", num)
-				_, err = os.Lstat(fname)
+			opened := w.opened
+			if previous != w.filename {
+				opened = fi.ModTime()
 			}
-			// return error if the last file checked still existed
-			if err == nil {
-				return fmt.Errorf("Rotate: Cannot find free log number to rename %s\n", w.filename)
+			fname, err := w.backupName(opened)
+			if err != nil {
+				return err
 			}
 
 			// Rename the file to its newfound home
@@ -154,42 +419,406 @@ func (w *FileLogWriter) intRotate() error {
 			if err != nil {
 				return fmt.Errorf("Rotate: %s\n", err)
 			}
+			w.maintain(fname)
 		}
 	}
 
+	return w.open(now)
+}
+
+// recover compresses, in the background, any rotated files which are not
+// compressed yet, such as those left by a process which died.  It looks for
+// them once, when the writer is first used and its settings are final, and
+// before it has rotated anything itself.  It must only be called by the
+// writing goroutine.
+func (w *FileLogWriter) recover() {
+	if w.recovered {
+		return
+	}
+	w.recovered = true
+	if w.compression == CompressNone {
+		return
+	}
+	b := w.rotated()
+	if uncompressed := b.recoverCompression(); len(uncompressed) > 0 {
+		w.background(func() {
+			for _, name := range uncompressed {
+				b.compress(name)
+			}
+		})
+	}
+}
+
+// lockedRotate rotates the file.  If other processes share it, it holds the
+// lock file while doing so, and only opens the new file if another process
+// has rotated it first.
+func (w *FileLogWriter) lockedRotate() error {
+	if !w.shared {
+		return w.intRotate()
+	}
+	lock, err := os.OpenFile(w.lockName(), os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return fmt.Errorf("Rotate: %s\n", err)
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return fmt.Errorf("Rotate: lock: %s\n", err)
+	}
+	defer unlockFile(lock)
+
+	if w.file != nil && w.moved() {
+		return w.follow()
+	}
+	return w.intRotate()
+}
+
+// lockName returns the name of the file locked around rotation.  It is the
+// same for every period of a filename pattern.
+func (w *FileLogWriter) lockName() string {
+	if w.pattern != "" {
+		return w.pattern + ".lock"
+	}
+	return w.filename + ".lock"
+}
+
+// follow keeps up with the other processes sharing the file: if one has
+// rotated it, it opens the new file, and it takes the size from the file
+// rather than counting only what this process wrote.
+func (w *FileLogWriter) follow() error {
+	if w.moved() {
+		// The trailer was written by the process which rotated it
+		w.closeFile(false)
+		if err := w.open(time.Now()); err != nil {
+			return err
+		}
+	}
+	fi, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	w.maxsize_cursize = int(fi.Size())
+	w.maxsize_cursize += len(w.pending)
+	return nil
+}
+
+// open opens w.filename, appending to it if it exists, and starts counting
+// towards the next rotation.
+func (w *FileLogWriter) open(now time.Time) error {
 	// Open the log file
 	fd, err := os.OpenFile(w.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
 	if err != nil {
 		return err
 	}
 	w.file = fd
-	fmt.Fprint(w.file, FormatLogRecord(w.header, &LogRecord{Created: time.Now()}))
-
-	// Set the daily open date to the current date
-	w.daily_opendate = time.Now().Day()
 
 	// initialize rotation values
+	w.opened = now
 	w.maxlines_curlines = 0
 	w.maxsize_cursize = 0
+	if w.rotate {
+		w.resume()
+	}
+	w.scheduleRotation()
+	w.writeHeader()
 
+	// The file is open, so a broken link does not stop logging
+	if w.symlink != "" {
+		if err := w.updateSymlink(); err != nil {
+			w.reportError(err)
+		}
+	}
 	return nil
 }
 
+// writeHeader writes the header, unless the file already has something in it,
+// as it does when appending to a file written before or by another process.
+func (w *FileLogWriter) writeHeader() {
+	if fi, err := w.file.Stat(); err == nil && fi.Size() == 0 {
+		fmt.Fprint(w.file, FormatLogRecord(w.header, &LogRecord{Created: time.Now()}))
+	}
+}
+
+// resume takes the rotation values from the file just opened, which may have
+// been written before, so that the limits hold across restarts: its size, its
+// number of lines if they are counted, and the time it was last written if it
+// is not empty.  A file last written before the start of the day is rotated
+// by the next record, if rotating daily.
+func (w *FileLogWriter) resume() {
+	fi, err := w.file.Stat()
+	if err != nil || fi.Size() == 0 {
+		return
+	}
+	w.maxsize_cursize = int(fi.Size())
+	if fi.ModTime().Before(w.opened) {
+		w.opened = fi.ModTime()
+	}
+	if w.countlines {
+		if lines, err := countLines(w.filename); err == nil {
+			w.maxlines_curlines = lines
+		}
+	}
+}
+
+// countLines returns the number of lines in the file called name.
+func countLines(name string) (int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	lines := 0
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		lines += bytes.Count(buf[:n], []byte{'\n'})
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+	}
+}
+
+// The extension of the temporary name a new symlink is made under, before it
+// is renamed over the old one.
+const symlinkTempExt = ".link"
+
+// updateSymlink points the symlink at the current file.  The new link is made
+// under a temporary name and renamed over the old one, so that the name always
+// refers to a file.  Anything but a symlink is left alone.
+func (w *FileLogWriter) updateSymlink() error {
+	if fi, err := os.Lstat(w.symlink); err == nil && fi.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("Symlink: %s exists and is not a symlink", w.symlink)
+	}
+	// Both names are relative to the working directory, but the target is
+	// relative to the symlink's directory
+	filename, symlink := w.filename, w.symlink
+	if filepath.IsAbs(filename) != filepath.IsAbs(symlink) {
+		var err error
+		if filename, err = filepath.Abs(filename); err == nil {
+			symlink, err = filepath.Abs(symlink)
+		}
+		if err != nil {
+			return fmt.Errorf("Symlink: %s", err)
+		}
+	}
+	target := filename
+	if rel, err := filepath.Rel(filepath.Dir(symlink), filename); err == nil {
+		target = rel
+	}
+	if current, err := os.Readlink(w.symlink); err == nil && current == target {
+		return nil
+	}
+
+	// Processes sharing the file each use their own temporary name
+	tmp := fmt.Sprintf("%s.%d%s", w.symlink, os.Getpid(), symlinkTempExt)
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return fmt.Errorf("Symlink: %s", err)
+	}
+	if err := os.Rename(tmp, w.symlink); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Symlink: %s", err)
+	}
+	return nil
+}
+
+// Request that the file be closed and opened again once the records already
+// sent are written, without rotating it.  This lets the writer follow a file
+// which has been moved away, as by logrotate without copytruncate.
+func (w *FileLogWriter) Reopen() {
+	w.control(context.Background(), w.intReopen)
+}
+
+// intReopen closes the file and opens w.filename again.  It must only be
+// called by the writing goroutine.
+func (w *FileLogWriter) intReopen() error {
+	if w.file != nil {
+		w.closeFile(true)
+	}
+	return w.open(time.Now())
+}
+
+// moved reports whether the open file is no longer at w.filename, because it
+// has been moved or deleted.
+func (w *FileLogWriter) moved() bool {
+	fi, err := os.Stat(w.filename)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	cur, err := w.file.Stat()
+	return err == nil && !os.SameFile(fi, cur)
+}
+
+// ReopenOnSignal reopens the file, as Reopen does, whenever one of the given
+// signals arrives, until the writer is closed (chainable).  With no signals,
+// it listens for SIGHUP, except on systems (such as Windows) which have none.
+// Pass syscall.SIGUSR1 to use that instead.
+func (w *FileLogWriter) ReopenOnSignal(sigs ...os.Signal) *FileLogWriter {
+	if len(sigs) == 0 {
+		sigs = reopenSignals
+	}
+	if len(sigs) == 0 {
+		return w
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ch:
+				w.Reopen()
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// SetReopenOnMove makes the writer check, at most once per interval, whether
+// its file has been moved or deleted, and if so open a new one (chainable).
+// Zero, the default, turns the check off.  Must be called before the first log
+// message is written.
+func (w *FileLogWriter) SetReopenOnMove(interval time.Duration) *FileLogWriter {
+	w.reopenCheck = interval
+	return w
+}
+
+// SetBuffer buffers up to size bytes of records in memory, writing them to the
+// file when the buffer is full, at least once per interval, and whenever the
+// file is flushed, synced, rotated or closed (chainable).  Records still in
+// the buffer are lost if the process dies.  A size of zero, the default,
+// writes each record as it comes.  Must be called before the first log
+// message is written.
+func (w *FileLogWriter) SetBuffer(size int, interval time.Duration) *FileLogWriter {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	w.bufsize, w.flushInterval = size, interval
+	return w
+}
+
+// SetSyncPolicy sets when the file is committed to stable storage
+// (chainable).  The default, SyncNever, leaves it to the operating system,
+// while SyncLevel lets a high volume of DEBUG records go without syncing but
+// makes sure of the ERROR records.  Must be called before the first log
+// message is written.
+func (w *FileLogWriter) SetSyncPolicy(policy SyncPolicy) *FileLogWriter {
+	w.syncPolicy = policy
+	return w
+}
+
+// SetSyncInterval sets how often SyncInterval syncs the file (chainable).  The
+// default is once a second.  Must be called before the first log message is
+// written.
+func (w *FileLogWriter) SetSyncInterval(interval time.Duration) *FileLogWriter {
+	if interval > 0 {
+		w.syncInterval = interval
+	}
+	return w
+}
+
+// SetSyncLevel sets the level at and above which SyncLevel syncs the file
+// after each record (chainable).  The default is ERROR.  Must be called before
+// the first log message is written.
+func (w *FileLogWriter) SetSyncLevel(lvl LogLevel) *FileLogWriter {
+	w.syncLevel = lvl
+	return w
+}
+
+// SetMultiProcess makes the writer safe to use when other processes write to
+// the same file, and do the same (chainable).  Rotation is done holding an
+// advisory lock on the file name plus ".lock", and only by the first process
+// to take it; the others open the new file once they see it has been moved.
+// The size limit goes by the size of the file, which is checked before each
+// record, but the line limit only counts this process's lines.  Locking needs
+// flock, so rotation is not coordinated on systems without it, such as
+// Windows.  Must be called before the first log message is written.
+func (w *FileLogWriter) SetMultiProcess(shared bool) *FileLogWriter {
+	w.shared = shared
+	return w
+}
+
+// SetSymlink keeps a symlink called name pointing at the current file, such as
+// app.log pointing at app-20091013.log for a pattern, so that tail -F and log
+// shippers can follow the file across rotations (chainable).  The link is
+// replaced atomically whenever a new file is opened, and is relative if the
+// file is given the same way.  A file called name which is not a symlink is
+// never replaced.  Must be called before the first log message is written.
+func (w *FileLogWriter) SetSymlink(name string) *FileLogWriter {
+	w.symlink = name
+	if name != "" && w.file != nil {
+		if err := w.updateSymlink(); err != nil {
+			fmt.Fprintf(stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+		}
+	}
+	return w
+}
+
+// SetOverflowPolicy sets what happens to records logged while the output
+// buffer is full (chainable).  The fallback LogWriter is only used by
+// OverflowSpill, and is not closed by this writer.  Must be called before the
+// first log message is written.
+func (w *FileLogWriter) SetOverflowPolicy(policy OverflowPolicy, fallback LogWriter) *FileLogWriter {
+	w.policy, w.fallback = policy, fallback
+	return w
+}
+
+// OverflowStats returns the number of records which could not be buffered.
+func (w *FileLogWriter) OverflowStats() OverflowStats {
+	return w.stats()
+}
+
+// SetErrorHandler sets a function to call with the errors from writing
+// records, and from compressing and removing rotated files, instead of
+// printing them to standard error (chainable).  It is called from the writing
+// goroutine or the one maintaining the rotated files, one call at a time, and
+// must not log to this writer.  Must be called before the first log message
+// is written.
+func (w *FileLogWriter) SetErrorHandler(handler func(err error)) *FileLogWriter {
+	w.onError = handler
+	return w
+}
+
+// SetRetryPolicy sets how failed writes are retried before records fall back
+// to standard error (chainable).  Must be called before the first log message
+// is written.
+func (w *FileLogWriter) SetRetryPolicy(policy RetryPolicy) *FileLogWriter {
+	w.retry = policy
+	return w
+}
+
 // Set the logging format (chainable).  Must be called before the first log
 // message is written.
 func (w *FileLogWriter) SetFormat(format string) *FileLogWriter {
-	w.format = format
+	w.formatter = CompileFormat(format)
 	return w
 }
 
+// SetFormatter sets the Formatter used to render records, in place of a
+// format pattern (chainable).  Must be called before the first log message is
+// written.
+func (w *FileLogWriter) SetFormatter(formatter Formatter) *FileLogWriter {
+	w.formatter = formatter
+	return w
+}
+
+// wantsGoroutine reports whether the records need the id of the goroutine
+// which logged them.
+func (w *FileLogWriter) wantsGoroutine() bool {
+	return formatsGoroutine(w.formatter)
+}
+
 // Set the logfile header and footer (chainable).  Must be called before the first log
 // message is written.  These are formatted similar to the FormatLogRecord (e.g.
 // you can use %D and %T in your header/footer for date and time).
 func (w *FileLogWriter) SetHeadFoot(head, foot string) *FileLogWriter {
 	w.header, w.trailer = head, foot
-	if w.maxlines_curlines == 0 {
-		fmt.Fprint(w.file, FormatLogRecord(w.header, &LogRecord{Created: time.Now()}))
-	}
+	w.writeHeader()
 	return w
 }
 
@@ -201,6 +830,18 @@ func (w *FileLogWriter) SetRotateLines(maxlines int) *FileLogWriter {
 	return w
 }
 
+// SetCountExistingLines makes the line limit count the lines already in a file
+// which is appended to, as after a restart, rather than starting from zero
+// (chainable).  This reads the whole file, so it is off by default.  Must be
+// called before the first log message is written.
+func (w *FileLogWriter) SetCountExistingLines(count bool) *FileLogWriter {
+	w.countlines = count
+	if count && w.rotate && w.file != nil {
+		w.resume()
+	}
+	return w
+}
+
 // Set rotate at size (chainable). Must be called before the first log message
 // is written.
 func (w *FileLogWriter) SetRotateSize(maxsize int) *FileLogWriter {
@@ -214,6 +855,59 @@ func (w *FileLogWriter) SetRotateSize(maxsize int) *FileLogWriter {
 func (w *FileLogWriter) SetRotateDaily(daily bool) *FileLogWriter {
 	//fmt.Fprintf(os.Stderr, "FileLogWriter.SetRotateDaily: %v\n", daily)
 	w.daily = daily
+	w.scheduleRotation()
+	return w
+}
+
+// Set rotate at the start of every hour (chainable).  Must be called before
+// the first log message is written.
+func (w *FileLogWriter) SetRotateHourly(hourly bool) *FileLogWriter {
+	w.hourly = hourly
+	w.scheduleRotation()
+	return w
+}
+
+// Set rotate at the end of every interval (chainable).  Rotations fall on
+// whole multiples of the interval counted from Go's zero time, which for an
+// interval dividing a day is the same as counting from midnight UTC: 15
+// minutes rotates on the quarter hour, and 6 hours at 0:00, 6:00 and so on.
+// Other intervals, such as 7 hours, do not restart at midnight.  Zero turns it
+// off.  Must be called before the first log message is written.
+func (w *FileLogWriter) SetRotateInterval(interval time.Duration) *FileLogWriter {
+	w.interval = interval
+	w.scheduleRotation()
+	return w
+}
+
+// scheduleRotation works out when the file which was opened at w.opened must
+// be rotated because of its age.
+func (w *FileLogWriter) scheduleRotation() {
+	w.rotateAt = time.Time{}
+	earliest := func(t time.Time) {
+		if w.rotateAt.IsZero() || t.Before(w.rotateAt) {
+			w.rotateAt = t
+		}
+	}
+	if w.daily {
+		earliest(nextPeriod(w.opened, 'd'))
+	}
+	if w.hourly {
+		earliest(nextPeriod(w.opened, 'H'))
+	}
+	if w.interval > 0 {
+		earliest(w.opened.Truncate(w.interval).Add(w.interval))
+	}
+	if period := filenamePeriod(w.pattern); period != 0 {
+		earliest(nextPeriod(w.opened, period))
+	}
+}
+
+// SetBackupNaming sets how rotated files are named (chainable).  With
+// BackupShift, as with logrotate, the file just rotated out is always .1, and
+// the older ones are renumbered to make way for it.  Must be called before the
+// first log message is written.
+func (w *FileLogWriter) SetBackupNaming(naming BackupNaming) *FileLogWriter {
+	w.naming = naming
 	return w
 }
 
@@ -223,10 +917,55 @@ func (w *FileLogWriter) SetRotateDaily(daily bool) *FileLogWriter {
 // new log is opened.
 func (w *FileLogWriter) SetRotate(rotate bool) *FileLogWriter {
 	//fmt.Fprintf(os.Stderr, "FileLogWriter.SetRotate: %v\n", rotate)
+	if rotate && !w.rotate && w.file != nil {
+		// The file was opened without taking the values from it
+		w.rotate = true
+		w.resume()
+		w.scheduleRotation()
+	}
 	w.rotate = rotate
 	return w
 }
 
+// SetCompress sets how rotated files are compressed (chainable).  Files are
+// compressed in the background, under a temporary name until they are
+// complete, so logging does not wait for them and an interrupted compression
+// never leaves a truncated file behind.  Any rotated files which are not
+// compressed yet, such as those left by a process which died, are compressed
+// once the first record is written or the file is first rotated.  Must be
+// called before the first log message is written.
+func (w *FileLogWriter) SetCompress(compression Compression) *FileLogWriter {
+	w.compression = compression
+	return w
+}
+
+// SetMaxBackups sets the number of rotated files to keep (chainable).  After
+// each rotation, all but the newest maxbackups are removed.  Zero, the
+// default, keeps them all.  Must be called before the first log message is
+// written.
+func (w *FileLogWriter) SetMaxBackups(maxbackups int) *FileLogWriter {
+	w.maxbackups = maxbackups
+	return w
+}
+
+// SetMaxAge sets how long rotated files are kept (chainable).  After each
+// rotation, files last written more than maxage ago are removed.  Zero, the
+// default, keeps them regardless of age.  Must be called before the first log
+// message is written.
+func (w *FileLogWriter) SetMaxAge(maxage time.Duration) *FileLogWriter {
+	w.maxage = maxage
+	return w
+}
+
+// SetMaxTotalSize limits the total size of the rotated files, after any
+// compression (chainable).  After each rotation, the oldest files are removed
+// until the rest fit.  Zero, the default, sets no limit.  Must be called
+// before the first log message is written.
+func (w *FileLogWriter) SetMaxTotalSize(maxtotalsize int64) *FileLogWriter {
+	w.maxtotalsize = maxtotalsize
+	return w
+}
+
 // NewXMLLogWriter is a utility method for creating a FileLogWriter set up to
 // output XML record log messages instead of line-based ones.
 func NewXMLLogWriter(fname string, rotate bool) *FileLogWriter {
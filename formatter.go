@@ -0,0 +1,321 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// A Formatter renders LogRecords for a LogWriter.  All of the built-in
+// LogWriters accept any Formatter through their SetFormatter methods.
+// Formatters may be shared between LogWriters, so Format must be safe to call
+// from multiple goroutines.
+type Formatter interface {
+	// Format appends the rendered record, including a trailing newline, to
+	// buf and returns the extended buffer.
+	Format(buf []byte, rec *LogRecord) []byte
+}
+
+// PatternFormatter formats records according to a FormatLogRecord pattern,
+// such as FORMAT_DEFAULT.  The pattern is compiled the first time it is used;
+// a CompiledFormat avoids looking it up for every record.
+type PatternFormatter string
+
+func (f PatternFormatter) Format(buf []byte, rec *LogRecord) []byte {
+	return compiledFormat(string(f)).Format(buf, rec)
+}
+
+// formatsGoroutine reports whether f writes the id of the logging goroutine
+// (%G), which is only worked out for records which need it.
+func formatsGoroutine(f Formatter) bool {
+	switch f := f.(type) {
+	case *CompiledFormat:
+		return f.routine
+	case PatternFormatter:
+		return compiledFormat(string(f)).routine
+	}
+	return false
+}
+
+// JSONFormatter formats each record as a JSON object on a line of its own,
+// with the keys in a fixed order:
+//
+//	{"ts":"2009-02-13T23:31:30.000000123Z","level":"ERROR","level_num":3,
+//	 "func":"main.main","file":"/src/main.go","line":12,"prefix":"web",
+//	 "msg":"the message","fields":{"user":"kevlar"}}
+//
+// The time is in RFC 3339 format with nanoseconds, in Location if it is set.
+// The func, file and line keys are omitted when the source is unknown, and
+// prefix and fields when they are empty.  The key names can be changed by
+// setting the corresponding fields; the zero JSONFormatter uses the names
+// above.
+type JSONFormatter struct {
+	Location *time.Location // Default the zone of each record's Created time
+
+	TimeKey     string // Default "ts"
+	LevelKey    string // Default "level"
+	LevelNumKey string // Default "level_num"
+	FuncKey     string // Default "func"
+	FileKey     string // Default "file"
+	LineKey     string // Default "line"
+	PrefixKey   string // Default "prefix"
+	MessageKey  string // Default "msg"
+	FieldsKey   string // Default "fields"
+}
+
+func (f JSONFormatter) Format(buf []byte, rec *LogRecord) []byte {
+	buf = append(buf, '{')
+	buf = appendJSONKey(buf, f.TimeKey, "ts", true)
+	buf = append(buf, '"')
+	buf = inLocation(rec.Created, f.Location).AppendFormat(buf, time.RFC3339Nano)
+	buf = append(buf, '"')
+
+	buf = appendJSONKey(buf, f.LevelKey, "level", false)
+	if rec.Level >= 0 && int(rec.Level) < len(levelFullStrings) {
+		buf = appendJSONString(buf, levelFullStrings[rec.Level])
+	} else {
+		buf = appendJSONString(buf, rec.Level.String())
+	}
+	buf = appendJSONKey(buf, f.LevelNumKey, "level_num", false)
+	buf = strconv.AppendInt(buf, int64(rec.Level), 10)
+
+	if fn := rec.SourceFunc(); fn != "" {
+		buf = appendJSONKey(buf, f.FuncKey, "func", false)
+		buf = appendJSONString(buf, fn)
+	}
+	if rec.File != "" {
+		buf = appendJSONKey(buf, f.FileKey, "file", false)
+		buf = appendJSONString(buf, rec.File)
+	}
+	if rec.Line > 0 {
+		buf = appendJSONKey(buf, f.LineKey, "line", false)
+		buf = strconv.AppendInt(buf, int64(rec.Line), 10)
+	}
+	if rec.Prefix != "" {
+		buf = appendJSONKey(buf, f.PrefixKey, "prefix", false)
+		buf = appendJSONString(buf, rec.Prefix)
+	}
+
+	buf = appendJSONKey(buf, f.MessageKey, "msg", false)
+	buf = appendJSONString(buf, rec.Message)
+
+	if len(rec.Fields) > 0 {
+		buf = appendJSONKey(buf, f.FieldsKey, "fields", false)
+		buf = append(buf, '{')
+		for i, field := range rec.Fields {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONString(buf, field.Key)
+			buf = append(buf, ':')
+			buf = appendJSONValue(buf, field.Value)
+		}
+		buf = append(buf, '}')
+	}
+	return append(buf, '}', '\n')
+}
+
+// inLocation returns t in loc, or t unchanged if loc is nil.
+func inLocation(t time.Time, loc *time.Location) time.Time {
+	if loc == nil {
+		return t
+	}
+	return t.In(loc)
+}
+
+// appendJSONKey appends `"key":`, using def if key is empty, preceded by a
+// comma unless it is the first key.
+func appendJSONKey(buf []byte, key, def string, first bool) []byte {
+	if !first {
+		buf = append(buf, ',')
+	}
+	if key == "" {
+		key = def
+	}
+	buf = appendJSONString(buf, key)
+	return append(buf, ':')
+}
+
+// appendJSONValue appends the JSON encoding of value.  Errors are encoded as
+// their message, and values which cannot be marshaled as their %v string.
+func appendJSONValue(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case string:
+		return appendJSONString(buf, v)
+	case error:
+		return appendJSONString(buf, v.Error())
+	}
+	js, err := json.Marshal(value)
+	if err != nil {
+		return appendJSONString(buf, fmt.Sprint(value))
+	}
+	return append(buf, js...)
+}
+
+// appendJSONString appends s as a quoted JSON string.
+func appendJSONString(buf []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c >= 0x20 && c != '"' && c != '\\' && c < utf8.RuneSelf {
+			i++
+			continue
+		}
+		if c < utf8.RuneSelf {
+			buf = append(buf, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				buf = append(buf, '\\', c)
+			case '\n':
+				buf = append(buf, '\\', 'n')
+			case '\r':
+				buf = append(buf, '\\', 'r')
+			case '\t':
+				buf = append(buf, '\\', 't')
+			default:
+				buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		// U+2028 and U+2029 are valid JSON but break JavaScript parsers
+		if r == '\u2028' || r == '\u2029' {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, `\u202`...)
+			buf = append(buf, hex[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
+}
+
+// LogfmtFormatter formats each record as a line of logfmt key=value pairs:
+//
+//	ts=2009-02-13T23:31:30Z level=error src=main.main:12 msg="the message"
+//
+// followed by prefix (if set) and the record's fields.  Values are quoted
+// when they are empty or contain spaces, quotes, equals signs, backslashes or
+// control characters, and quoted values use JSON string escapes.  Characters
+// which are not allowed in keys are replaced with underscores.  The time is in
+// Location if it is set, and otherwise in the zone of the record.
+type LogfmtFormatter struct {
+	Location *time.Location
+}
+
+func (f LogfmtFormatter) Format(buf []byte, rec *LogRecord) []byte {
+	buf = append(buf, "ts="...)
+	buf = inLocation(rec.Created, f.Location).AppendFormat(buf, time.RFC3339)
+	buf = append(buf, " level="...)
+	if rec.Level >= 0 && int(rec.Level) < len(levelFullStrings) {
+		buf = append(buf, strings.ToLower(levelFullStrings[rec.Level])...)
+	} else {
+		buf = appendLogfmtValue(buf, rec.Level.String())
+	}
+	if rec.Source != "" {
+		buf = append(buf, " src="...)
+		buf = appendLogfmtValue(buf, rec.Source)
+	}
+	buf = append(buf, " msg="...)
+	buf = appendLogfmtValue(buf, rec.Message)
+	if rec.Prefix != "" {
+		buf = append(buf, " prefix="...)
+		buf = appendLogfmtValue(buf, rec.Prefix)
+	}
+	for _, field := range rec.Fields {
+		buf = append(buf, ' ')
+		buf = appendLogfmtKey(buf, field.Key)
+		buf = append(buf, '=')
+		switch v := field.Value.(type) {
+		case string:
+			buf = appendLogfmtValue(buf, v)
+		case error:
+			buf = appendLogfmtValue(buf, v.Error())
+		default:
+			buf = appendLogfmtValue(buf, fmt.Sprint(v))
+		}
+	}
+	return append(buf, '\n')
+}
+
+// appendLogfmtKey appends key with any characters which would end a logfmt
+// key (spaces, '=', '"' and control characters) replaced by '_'.
+func appendLogfmtKey(buf []byte, key string) []byte {
+	if key == "" {
+		return append(buf, '_')
+	}
+	for _, r := range key {
+		if r <= ' ' || r == '=' || r == '"' || r == 0x7f || r == utf8.RuneError {
+			r = '_'
+		}
+		buf = utf8.AppendRune(buf, r)
+	}
+	return buf
+}
+
+// appendLogfmtValue appends value, as a quoted and escaped string if it is
+// empty or contains anything which would otherwise end or confuse the value.
+func appendLogfmtValue(buf []byte, value string) []byte {
+	if value == "" {
+		return append(buf, `""`...)
+	}
+	for _, r := range value {
+		if r <= ' ' || r == '"' || r == '=' || r == '\\' || r == 0x7f || r == utf8.RuneError || r == '\u2028' || r == '\u2029' {
+			return appendJSONString(buf, value)
+		}
+	}
+	return append(buf, value...)
+}
+
+// consoleFormatter is the ConsoleLogWriter's original output format:
+//
+//	CRIT Fri, 13 Feb 2009 23:31:30 UTC prefix: message key=value
+type consoleFormatter struct {
+	location *time.Location
+}
+
+func (f consoleFormatter) Format(buf []byte, rec *LogRecord) []byte {
+	buf = append(buf, levelStrings[rec.Level]...)
+	buf = append(buf, ' ')
+	buf = inLocation(rec.Created, f.location).AppendFormat(buf, time.RFC1123)
+	buf = append(buf, ' ')
+	buf = append(buf, rec.Prefix...)
+	buf = append(buf, ": "...)
+	buf = append(buf, rec.Message...)
+	if len(rec.Fields) > 0 {
+		buf = append(buf, ' ')
+		buf = append(buf, rec.Fields.String()...)
+	}
+	return append(buf, '\n')
+}
+
+// socketFormatter is the SocketLogWriter's original output format: the record
+// marshaled as JSON, without a trailing newline.
+type socketFormatter struct{}
+
+func (f socketFormatter) Format(buf []byte, rec *LogRecord) []byte {
+	js, err := json.Marshal(rec)
+	if err != nil {
+		return buf
+	}
+	return append(buf, js...)
+}
@@ -26,29 +26,38 @@
 //   output, but the FileLogWriter does.
 // - The utility functions (Info, Debug, Warn, etc) derive their source from the
 //   calling function, and this incurs extra overhead.
+// - A Logger may be reconfigured (AddFilter, RemoveFilter, SetLevel, Close)
+//   while other goroutines are logging through it.
 //
 // Changes from 2.0:
 // - The external interface has remained mostly stable, but a lot of the
 //   internals have been changed, so if you depended on any of this or created
 //   your own LogWriter, then you will probably have to update your code.  In
-//   particular, Logger is now a map and ConsoleLogWriter is now a channel
-//   behind-the-scenes, and the LogWrite method no longer has return values.
+//   particular, Logger is now a struct sharing a set of filters, the built-in
+//   LogWriters each write from their own goroutine behind-the-scenes, and the
+//   LogWrite method no longer has return values.
 //
 // Future work: (please let me know if you think I should work on any of these particularly)
 // - Log file rotation
 // - Logging configuration files ala log4j
-// - Have the ability to remove filters?
 // - Have GetInfoChannel, GetDebugChannel, etc return a chan string that allows
 //   for another method of logging
 // - Add an XML filter type
 package log4go
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -105,17 +114,115 @@ var (
 	// LogBufferLength specifies how many log messages a particular log4go
 	// logger can buffer at a time before writing them.
 	LogBufferLength = 32
+
+	// ExitTimeout specifies how long Crash, Crashf, Exit and Exitf wait for
+	// pending log messages to be written before giving up.
+	ExitTimeout = 5 * time.Second
 )
 
 /****** LogRecord ******/
 
 // A LogRecord contains all of the pertinent information for each message
 type LogRecord struct {
-	Level   LogLevel // The log level
-	Created time.Time    // The time at which the log message was created (nanoseconds)
-	Source  string   // The message source
-	Prefix  string   // The log message
-	Message string   // The log message
+	Level   LogLevel  // The log level
+	Created time.Time // The time at which the log message was created (nanoseconds)
+	Source  string    // The message source
+	Prefix  string    // The log message
+	Message string    // The log message
+	Fields  Fields    `json:",omitempty"` // Structured key/value context (see Logger.With)
+	File    string    `json:",omitempty"` // The source file, if known
+	Line    int       `json:",omitempty"` // The source line, if known
+
+	Goroutine int64 `json:",omitempty"` // The id of the logging goroutine, if a writer needs it
+}
+
+// SourceFunc returns the function part of the record's Source, which is
+// normally of the form "function:line".
+func (rec *LogRecord) SourceFunc() string {
+	if i := strings.LastIndex(rec.Source, ":"); i >= 0 {
+		if _, err := strconv.Atoi(rec.Source[i+1:]); err == nil {
+			return rec.Source[:i]
+		}
+	}
+	return rec.Source
+}
+
+/****** Fields ******/
+
+// A Field is a single piece of structured context attached to a LogRecord.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Fields is an ordered list of key/value pairs.  Keys are not required to be
+// unique; writers render them in the order they were added.
+type Fields []Field
+
+// makeFields builds Fields from alternating keys and values.  Keys which are
+// not strings are formatted with %v, and a trailing key without a value is
+// given a nil value.
+func makeFields(keyvals []interface{}) Fields {
+	fields := make(Fields, 0, (len(keyvals)+1)/2)
+	for i := 0; i < len(keyvals); i += 2 {
+		key, ok := keyvals[i].(string)
+		if !ok {
+			key = fmt.Sprint(keyvals[i])
+		}
+		var value interface{}
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		fields = append(fields, Field{key, value})
+	}
+	return fields
+}
+
+// String renders the fields as space-separated key=value pairs.  Values which
+// contain spaces, quotes or equals signs are quoted.
+func (f Fields) String() string {
+	return string(f.appendTo(make([]byte, 0, 16*len(f))))
+}
+
+// appendTo appends the fields, formatted as by String, to buf.
+func (f Fields) appendTo(buf []byte) []byte {
+	for i, field := range f {
+		if i > 0 {
+			buf = append(buf, ' ')
+		}
+		buf = append(buf, field.Key...)
+		buf = append(buf, '=')
+		value, ok := field.Value.(string)
+		if !ok {
+			value = fmt.Sprint(field.Value)
+		}
+		if value == "" || strings.ContainsAny(value, " \t\r\n\"=") {
+			buf = strconv.AppendQuote(buf, value)
+		} else {
+			buf = append(buf, value...)
+		}
+	}
+	return buf
+}
+
+// MarshalJSON encodes the fields as a JSON object, preserving their order.
+// Values which cannot be marshaled are encoded as their %v string.
+func (f Fields) MarshalJSON() ([]byte, error) {
+	buf := []byte{'{'}
+	for i, field := range f {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		key, _ := json.Marshal(field.Key)
+		buf = append(buf, key...)
+		buf = append(buf, ':')
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(field.Value))
+		}
+		buf = append(buf, value...)
+	}
+	return append(buf, '}'), nil
 }
 
 /****** LogWriter ******/
@@ -126,10 +233,20 @@ type LogWriter interface {
 	LogWrite(rec *LogRecord)
 
 	// This should clean up anything lingering about the LogWriter, as it is called before
-	// the LogWriter is removed.  LogWrite should not be called after Close.
+	// the LogWriter is removed.  Records passed to LogWrite before Close should be
+	// written before Close returns.  LogWrite should not be called after Close.
 	Close()
 }
 
+// A Flusher is a LogWriter which can wait for the records it has been sent to
+// be written out.  All of the built-in LogWriters are Flushers.
+type Flusher interface {
+	// Flush blocks until the records passed to LogWrite before the call have
+	// been written (and synced to stable storage, where that applies), or ctx
+	// is done.
+	Flush(ctx context.Context) error
+}
+
 /****** Logger ******/
 
 // A Filter represents the log level below which no log records are written to
@@ -141,15 +258,189 @@ type Filter struct {
 }
 
 // A Logger represents a collection of Filters through which log messages are
-// written.
-type Logger map[string]*Filter
-
-// Create a new logger.
+// written.  A Logger refers to shared state, so copies of it (and Loggers
+// derived from it with With) write through the same filters.  It is safe to
+// log, add and remove filters and change levels from multiple goroutines.
 //
-// DEPRECATED: Use make(Logger) instead.
+// The zero Logger discards everything; use NewLogger or NewDefaultLogger to
+// create a Logger that filters can be added to.
+type Logger struct {
+	core   *loggerCore
+	fields Fields
+}
+
+// loggerCore holds the filters shared by a Logger and its copies.  The current
+// filters are kept in an immutable filterSet which is replaced, never modified,
+// so logging only needs to load it atomically.  Changes are serialized by mu.
+type loggerCore struct {
+	mu      sync.Mutex
+	filters atomic.Value // *filterSet
+}
+
+// A filterSet is a snapshot of a Logger's filters.
+type filterSet struct {
+	names   []string  // Sorted filter names
+	filters []*Filter // The filters, in the same order as names
+	level   LogLevel  // The most verbose level accepted by any filter
+	active  int32     // Goroutines currently writing through this set
+
+	// Once the set has been replaced, drained is closed when no goroutine is
+	// writing through it any more
+	retired int32
+	drained chan struct{}
+	once    sync.Once
+
+	// The set this one replaced, while it or an older set may still be
+	// written through; guarded by loggerCore.mu
+	prev *filterSet
+}
+
+var noFilters = newFilterSet(nil)
+
+func newFilterSet(filters map[string]*Filter) *filterSet {
+	fs := &filterSet{level: INGORE, drained: make(chan struct{})}
+	for name := range filters {
+		fs.names = append(fs.names, name)
+	}
+	sort.Strings(fs.names)
+	for _, name := range fs.names {
+		filt := filters[name]
+		fs.filters = append(fs.filters, filt)
+		if filt.Level > fs.level {
+			fs.level = filt.Level
+		}
+	}
+	return fs
+}
+
+// load returns the current filters without registering as a user of them; it
+// is suitable only for reading levels and names.
+func (log Logger) load() *filterSet {
+	if log.core == nil {
+		return noFilters
+	}
+	return log.core.filters.Load().(*filterSet)
+}
+
+// acquire returns the current filters and registers the caller as writing
+// through them; release must be called when done.  The LogWriters of a
+// filterSet are not closed until everyone who acquired it has released it.
+func (log Logger) acquire() *filterSet {
+	if log.core == nil {
+		return noFilters
+	}
+	for {
+		fs := log.core.filters.Load().(*filterSet)
+		atomic.AddInt32(&fs.active, 1)
+		if log.core.filters.Load().(*filterSet) == fs {
+			return fs
+		}
+		// Replaced in the meantime; its writers may be closing.
+		fs.release()
+	}
+}
+
+// A goroutineWanter is a LogWriter whose records need the id of the logging
+// goroutine, which is too costly to find for every record.
+type goroutineWanter interface {
+	wantsGoroutine() bool
+}
+
+// wantsGoroutine reports whether any filter accepting lvl needs the id of the
+// logging goroutine.
+func (fs *filterSet) wantsGoroutine(lvl LogLevel) bool {
+	for _, filt := range fs.filters {
+		if lvl > filt.Level {
+			continue
+		}
+		if w, ok := filt.LogWriter.(goroutineWanter); ok && w.wantsGoroutine() {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *filterSet) release() {
+	if atomic.AddInt32(&fs.active, -1) == 0 && atomic.LoadInt32(&fs.retired) != 0 {
+		fs.drain()
+	}
+}
+
+func (fs *filterSet) drain() {
+	fs.once.Do(func() {
+		close(fs.drained)
+	})
+}
+
+// retire marks fs as replaced, so that drained is closed once no goroutine is
+// writing through it.  Goroutines which acquire it after that see that it was
+// replaced, and do not write through it.
+func (fs *filterSet) retire() {
+	atomic.StoreInt32(&fs.retired, 1)
+	if atomic.LoadInt32(&fs.active) == 0 {
+		fs.drain()
+	}
+}
+
+func (fs *filterSet) isDrained() bool {
+	select {
+	case <-fs.drained:
+		return true
+	default:
+		return false
+	}
+}
+
+// update replaces the Logger's filters with the result of applying edit to a
+// copy of them.  Once no goroutine is still writing through the old filters,
+// or any set of filters before them, the LogWriters returned by edit are
+// closed.  Other changes need not wait for that.
+func (log Logger) update(edit func(filters map[string]*Filter) []LogWriter) {
+	c := log.core
+	if c == nil {
+		panic("log4go: use of uninitialized Logger (see NewLogger)")
+	}
+	c.mu.Lock()
+	old := c.filters.Load().(*filterSet)
+	filters := make(map[string]*Filter, len(old.names)+1)
+	for i, name := range old.names {
+		filters[name] = old.filters[i]
+	}
+	closing := edit(filters)
+	fs := newFilterSet(filters)
+	fs.prev = old
+	c.filters.Store(fs)
+	old.retire()
+
+	// A writer may still be written through any earlier set which is not
+	// drained.  Those older than the oldest such set need not be kept.
+	var waiting []*filterSet
+	last := fs
+	for s := old; s != nil; s = s.prev {
+		if !s.isDrained() {
+			waiting = append(waiting, s)
+			last = s
+		}
+	}
+	last.prev = nil
+	c.mu.Unlock()
+
+	if len(closing) == 0 {
+		return
+	}
+	for _, s := range waiting {
+		<-s.drained
+	}
+	for _, w := range closing {
+		w.Close()
+	}
+}
+
+// NewLogger creates a new Logger with no filters.
 func NewLogger() Logger {
-	os.Stderr.WriteString("warning: use of deprecated NewLogger\n")
-	return make(Logger)
+	c := new(loggerCore)
+	c.filters.Store(newFilterSet(nil))
+	return Logger{core: c}
 }
 
 // Create a new logger with a "stdout" filter configured to send log messages at
@@ -158,17 +449,13 @@ func NewLogger() Logger {
 // DEPRECATED: use NewDefaultLogger instead.
 func NewConsoleLogger(lvl LogLevel) Logger {
 	os.Stderr.WriteString("warning: use of deprecated NewConsoleLogger\n")
-	return Logger{
-		"stdout": &Filter{lvl, "", NewConsoleLogWriter()},
-	}
+	return NewDefaultLogger(lvl)
 }
 
 // Create a new logger with a "stdout" filter configured to send log messages at
 // or above lvl to standard output.
 func NewDefaultLogger(lvl LogLevel) Logger {
-	return Logger{
-		"stdout": &Filter{lvl, "", NewConsoleLogWriter()},
-	}
+	return NewLogger().AddFilter("stdout", lvl, NewConsoleLogWriter())
 }
 
 // Closes all log writers in preparation for exiting the program or a
@@ -176,41 +463,197 @@ func NewDefaultLogger(lvl LogLevel) Logger {
 // you want to guarantee that all log messages are written.  Close removes
 // all filters (and thus all LogWriters) from the logger.
 func (log Logger) Close() {
-	// Close all open loggers
-	for name, filt := range log {
-		filt.Close()
-		delete(log, name)
+	if log.core == nil {
+		return
+	}
+	log.update(func(filters map[string]*Filter) (closing []LogWriter) {
+		for name, filt := range filters {
+			closing = append(closing, filt.LogWriter)
+			delete(filters, name)
+		}
+		return closing
+	})
+}
+
+// Flush waits until every LogWriter which is a Flusher has written (and
+// synced) the records sent to it so far, or ctx is done.  It returns the first
+// error encountered, if any.
+func (log Logger) Flush(ctx context.Context) error {
+	fs := log.acquire()
+	defer fs.release()
+
+	errs := make(chan error, len(fs.filters))
+	pending := 0
+	for _, filt := range fs.filters {
+		f, ok := filt.LogWriter.(Flusher)
+		if !ok {
+			continue
+		}
+		pending++
+		go func() {
+			errs <- f.Flush(ctx)
+		}()
+	}
+
+	var first error
+	for ; pending > 0; pending-- {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Shutdown flushes and then closes all log writers, as Close does, but gives
+// up waiting once ctx is done.  The writers continue to be closed in the
+// background if Shutdown returns early.
+func (log Logger) Shutdown(ctx context.Context) error {
+	err := log.Flush(ctx)
+	closed := make(chan bool)
+	go func() {
+		log.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
 // Add a new LogWriter to the Logger which will only log messages at lvl or
-// higher.  This function should not be called from multiple goroutines.
-// Returns the logger for chaining.
+// higher.  A filter with the same name is replaced, but its LogWriter is not
+// closed.  Returns the logger for chaining.
 func (log Logger) AddFilter(name string, lvl LogLevel, writer LogWriter) Logger {
-	log[name] = &Filter{lvl, "", writer}
+	log.addFilter(name, &Filter{lvl, "", writer})
+	return log
+}
+
+func (log Logger) addFilter(name string, filt *Filter) {
+	log.update(func(filters map[string]*Filter) []LogWriter {
+		filters[name] = filt
+		return nil
+	})
+}
+
+// RemoveFilter removes the named filter from the Logger and closes its
+// LogWriter, which writes out any records it has already been sent before
+// RemoveFilter returns.  Other filters are not affected.  It does nothing if
+// there is no such filter.
+func (log Logger) RemoveFilter(name string) {
+	log.update(func(filters map[string]*Filter) []LogWriter {
+		filt, ok := filters[name]
+		if !ok {
+			return nil
+		}
+		delete(filters, name)
+		return []LogWriter{filt.LogWriter}
+	})
+}
+
+// ReplaceFilter installs a new LogWriter under the given name, which will only
+// log messages at lvl or higher, and then closes the LogWriter it replaces (if
+// any) as RemoveFilter does.  No record is sent to both writers.
+func (log Logger) ReplaceFilter(name string, lvl LogLevel, writer LogWriter) {
+	log.update(func(filters map[string]*Filter) (closing []LogWriter) {
+		if filt, ok := filters[name]; ok {
+			closing = append(closing, filt.LogWriter)
+		}
+		filters[name] = &Filter{lvl, "", writer}
+		return closing
+	})
+}
+
+// SetLevel changes the level of the named filter.  It does nothing if there is
+// no such filter.
+func (log Logger) SetLevel(name string, lvl LogLevel) {
+	log.update(func(filters map[string]*Filter) []LogWriter {
+		if filt, ok := filters[name]; ok {
+			filters[name] = &Filter{lvl, filt.Prefix, filt.LogWriter}
+		}
+		return nil
+	})
+}
+
+// SetPrefix changes the prefix given to records written through the named
+// filter.  It does nothing if there is no such filter.
+func (log Logger) SetPrefix(name string, prefix string) {
+	log.update(func(filters map[string]*Filter) []LogWriter {
+		if filt, ok := filters[name]; ok {
+			filters[name] = &Filter{filt.Level, prefix, filt.LogWriter}
+		}
+		return nil
+	})
+}
+
+// Filters returns a copy of the Logger's current filters, keyed by name.
+// Changing the returned Filters does not affect the Logger.
+func (log Logger) Filters() map[string]*Filter {
+	fs := log.load()
+	filters := make(map[string]*Filter, len(fs.names))
+	for i, name := range fs.names {
+		filt := *fs.filters[i]
+		filters[name] = &filt
+	}
+	return filters
+}
+
+// With returns a derived Logger whose records carry the given key/value pairs
+// (alternating keys and values) in addition to any already attached to log.
+// The derived Logger shares its filters with log, so only one of them should
+// be closed.
+func (log Logger) With(keyvals ...interface{}) Logger {
+	fields := makeFields(keyvals)
+	// Force a copy so derived loggers never share a backing array
+	log.fields = append(log.fields[:len(log.fields):len(log.fields)], fields...)
 	return log
 }
 
 /******* Logging *******/
-// Send a formatted log message internally
-func (log Logger) intLogf(lvl LogLevel, format string, args ...interface{}) {
-	skip := true
-	prefix := ""
 
-	// Determine if any logging will be done
-	for _, filt := range log {
-		if lvl <= filt.Level {
-			skip = false
-			prefix = filt.Prefix
-			break
+// dispatch sends rec to every filter which accepts its level.  Filters with a
+// Prefix receive their own copy of rec carrying that prefix.
+func (log Logger) dispatch(rec *LogRecord) {
+	fs := log.acquire()
+	for _, filt := range fs.filters {
+		if rec.Level > filt.Level {
+			continue
+		}
+		if filt.Prefix != rec.Prefix {
+			prefixed := *rec
+			prefixed.Prefix = filt.Prefix
+			filt.LogWrite(&prefixed)
+			continue
 		}
+		filt.LogWrite(rec)
+	}
+	fs.release()
+}
+
+// goroutineID returns the id of the calling goroutine, as reported in the
+// first line of its stack trace ("goroutine 18 [running]:").
+func goroutineID() int64 {
+	var buf [32]byte
+	stack := buf[:runtime.Stack(buf[:], false)]
+	stack = bytes.TrimPrefix(stack, []byte("goroutine "))
+	if i := bytes.IndexByte(stack, ' '); i >= 0 {
+		stack = stack[:i]
 	}
-	if skip {
+	id, _ := strconv.ParseInt(string(stack), 10, 64)
+	return id
+}
+
+// Send a formatted log message internally
+func (log Logger) intLogf(lvl LogLevel, format string, args ...interface{}) {
+	// Determine if any logging will be done
+	fs := log.load()
+	if lvl > fs.level {
 		return
 	}
 
 	// Determine caller func
-	pc, _, lineno, ok := runtime.Caller(2)
+	pc, file, lineno, ok := runtime.Caller(2)
 	src := ""
 	if ok {
 		src = fmt.Sprintf("%s:%d", runtime.FuncForPC(pc).Name(), lineno)
@@ -220,92 +663,68 @@ func (log Logger) intLogf(lvl LogLevel, format string, args ...interface{}) {
 		msg = fmt.Sprintf(format, args...)
 	}
 
-	// Make the log record
+	// Make the log record and dispatch it
 	rec := &LogRecord{
 		Level:   lvl,
 		Created: time.Now(),
 		Source:  src,
-		Prefix:  prefix,
 		Message: msg,
+		Fields:  log.fields,
+		File:    file,
+		Line:    lineno,
 	}
-	// Dispatch the logs
-	for _, filt := range log {
-		if lvl > filt.Level {
-			continue
-		}
-		filt.LogWrite(rec)
+	if fs.wantsGoroutine(lvl) {
+		rec.Goroutine = goroutineID()
 	}
+	log.dispatch(rec)
 }
 
 // Send a closure log message internally
 func (log Logger) intLogc(lvl LogLevel, closure func() string) {
-	skip := true
-
 	// Determine if any logging will be done
-	for _, filt := range log {
-		if lvl <= filt.Level {
-			skip = false
-			break
-		}
-	}
-	if skip {
+	fs := log.load()
+	if lvl > fs.level {
 		return
 	}
 
 	// Determine caller func
-	pc, _, lineno, ok := runtime.Caller(2)
+	pc, file, lineno, ok := runtime.Caller(2)
 	src := ""
 	if ok {
 		src = fmt.Sprintf("%s:%d", runtime.FuncForPC(pc).Name(), lineno)
 	}
 
-	// Make the log record
+	// Make the log record and dispatch it
 	rec := &LogRecord{
 		Level:   lvl,
 		Created: time.Now(),
 		Source:  src,
 		Message: closure(),
+		Fields:  log.fields,
+		File:    file,
+		Line:    lineno,
 	}
-
-	// Dispatch the logs
-	for _, filt := range log {
-		if lvl > filt.Level {
-			continue
-		}
-		filt.LogWrite(rec)
+	if fs.wantsGoroutine(lvl) {
+		rec.Goroutine = goroutineID()
 	}
+	log.dispatch(rec)
 }
 
 // Send a log message with manual level, source, and message.
 func (log Logger) Log(lvl LogLevel, source, message string) {
-	skip := true
-
 	// Determine if any logging will be done
-	for _, filt := range log {
-		if lvl <= filt.Level {
-			skip = false
-			break
-		}
-	}
-	if skip {
+	if lvl > log.load().level {
 		return
 	}
 
-	// Make the log record
-	rec := &LogRecord{
+	// Make the log record and dispatch it
+	log.dispatch(&LogRecord{
 		Level:   lvl,
 		Created: time.Now(),
 		Source:  source,
 		Message: message,
-	}
-
-	// Dispatch the logs
-	for _, filt := range log {
-		if lvl > filt.Level {
-			continue
-		}
-		filt.LogWrite(rec)
-	}
+		Fields:  log.fields,
+	})
 }
 
 // Logf logs a formatted log message at the given log level, using the caller as
@@ -3,9 +3,17 @@
 package log4go
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -14,24 +22,62 @@ const (
 	FORMAT_ABBREV  = "[%L] %M"
 )
 
+// A formatCacheType holds the time and date strings for one second, so they
+// are not recomputed for every record.
 type formatCacheType struct {
 	LastUpdateSeconds    int64
+	location             *time.Location
 	shortTime, shortDate string
 	longTime, longDate   string
 }
 
-var formatCache = &formatCacheType{}
+// Process-wide values for %P and %H
+var (
+	formatPid      = strconv.Itoa(os.Getpid())
+	formatHostname = func() string {
+		host, err := os.Hostname()
+		if err != nil {
+			return "unknown"
+		}
+		return host
+	}()
+)
 
 // Known format codes:
 // %T - Time (15:04:05 MST)
 // %t - Time (15:04)
 // %D - Date (2006/01/02)
 // %d - Date (01/02/06)
+// %m - Milliseconds (000-999)
+// %u - Microseconds (000000-999999)
+// %n - Nanoseconds (000000000-999999999)
 // %L - Level (DEBG, NOTI, WARN, EROR, CRIT)
+// %V - Level, in full (DEBUG, NOTICE, WARNING, ERROR, CRITICAL)
 // %S - Source
+// %F - Short source file and line (log4go.go:123)
+// %f - Source file
+// %N - Source line
+// %G - Goroutine id
+// %P - Process id
+// %H - Hostname
+// %p - Prefix
 // %M - Message
+// %X - Structured fields (key=value key2=value2)
+// %% - A literal %
+// %{layout}T - Time in a Go time layout, such as %{2006-01-02T15:04:05.000Z07:00}T
+// %C - Start the level's color, when written by a colored ConsoleLogWriter
+// %c - End the color started by %C (which otherwise lasts to the end of the line)
 // Ignores unknown formats
 // Recommended: "[%D %T] [%L] (%S) %M"
+//
+// Like printf, a minimum width and a maximum length may be given between the
+// % and the code, as in %-5L or %20.40S.  Values shorter than the width are
+// padded with spaces on the left, or on the right if the width is preceded
+// by '-'.  Values longer than the maximum are truncated: the sources (%S, %F
+// and %f) keep their end, and everything else keeps its beginning.
+//
+// Times are in the zone of the record's Created time, which is normally the
+// local zone.  Use a CompiledFormat with SetLocation to choose another.
 func FormatLogRecord(format string, rec *LogRecord) string {
 	if rec == nil {
 		return "<nil>"
@@ -39,81 +85,422 @@ func FormatLogRecord(format string, rec *LogRecord) string {
 	if len(format) == 0 {
 		return ""
 	}
+	return string(compiledFormat(format).Format(nil, rec))
+}
+
+// compiledFormats caches the CompiledFormat for each format given to
+// FormatLogRecord or PatternFormatter, keyed by the format string.  Only the
+// first maxCompiledFormats formats are kept, so that a program which makes
+// up formats as it goes does not fill memory with them.
+var (
+	compiledFormats     sync.Map
+	compiledFormatCount int32
+)
+
+const maxCompiledFormats = 256
+
+// compiledFormat returns the cached CompiledFormat for format, compiling it if
+// it has not been seen before.
+func compiledFormat(format string) *CompiledFormat {
+	if cached, ok := compiledFormats.Load(format); ok {
+		return cached.(*CompiledFormat)
+	}
+	f := CompileFormat(format)
+	if atomic.AddInt32(&compiledFormatCount, 1) > maxCompiledFormats {
+		atomic.AddInt32(&compiledFormatCount, -1)
+		return f
+	}
+	cached, loaded := compiledFormats.LoadOrStore(format, f)
+	if loaded {
+		atomic.AddInt32(&compiledFormatCount, -1)
+	}
+	return cached.(*CompiledFormat)
+}
 
-	out := new(bytes.Buffer)
+// A CompiledFormat is a format string, as understood by FormatLogRecord, which
+// has been parsed ahead of time.  It is a Formatter, and appends records to
+// the buffer it is given without allocating.  SetFormat and
+// NewFormatLogWriter compile their formats, so this only needs to be used
+// directly to share one between writers or to format records by hand.
+type CompiledFormat struct {
+	format   string
+	pieces   []formatPiece
+	location *time.Location // Zone for times, or nil for the record's own
+	colored  bool           // Whether the format uses %C
+	routine  bool           // Whether the format uses %G
+
+	// The *formatCacheType for the most recent second formatted.  Each
+	// CompiledFormat has its own, since writers in different goroutines may
+	// format records from different seconds or in different zones.
+	cache atomic.Value
+}
+
+// A formatPiece is either literal text (verb 0) or a verb and its modifiers.
+type formatPiece struct {
+	verb    byte
+	literal string // The text, or the time layout for %{layout}T
+	width   int    // Minimum width, in runes
+	left    bool   // Pad on the right (left-justify) instead of the left
+	max     int    // Maximum length in runes, or -1 for no limit
+}
+
+// CompileFormat parses a format string as described by FormatLogRecord.
+func CompileFormat(format string) *CompiledFormat {
+	f := &CompiledFormat{format: format}
+	literal := make([]byte, 0, len(format))
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			literal = append(literal, format[i])
+			continue
+		}
+		if i+1 < len(format) && format[i+1] == '%' {
+			literal = append(literal, '%')
+			i++
+			continue
+		}
+
+		piece := formatPiece{max: -1}
+		i++
+		if i < len(format) && format[i] == '-' {
+			piece.left = true
+			i++
+		}
+		for ; i < len(format) && '0' <= format[i] && format[i] <= '9'; i++ {
+			piece.width = piece.width*10 + int(format[i]-'0')
+		}
+		if i < len(format) && format[i] == '.' {
+			piece.max = 0
+			for i++; i < len(format) && '0' <= format[i] && format[i] <= '9'; i++ {
+				piece.max = piece.max*10 + int(format[i]-'0')
+			}
+		}
+		if i < len(format) && format[i] == '{' {
+			end := strings.IndexByte(format[i:], '}')
+			if end < 0 {
+				break
+			}
+			piece.literal = format[i+1 : i+end]
+			i += end + 1
+		}
+		if i == len(format) {
+			break
+		}
+		if !strings.ContainsRune(formatVerbs, rune(format[i])) {
+			continue // Ignore unknown formats
+		}
+		if piece.literal != "" && format[i] != 'T' {
+			continue // Only %T takes a layout
+		}
+		piece.verb = format[i]
+		switch piece.verb {
+		case 'C':
+			f.colored = true
+		case 'G':
+			f.routine = true
+		}
 
-	cache := *formatCache
-	if cache.LastUpdateSeconds != rec.Created.Unix() {
-		zone, _ := rec.Created.Zone()
-		updated := &formatCacheType{
-			LastUpdateSeconds: rec.Created.Unix(),
-			shortTime:         fmt.Sprintf("%02d:%02d", rec.Created.Hour(), rec.Created.Minute()),
-			shortDate:         fmt.Sprintf("%02d/%02d/%02d", rec.Created.Month(), rec.Created.Day(), rec.Created.Year()%100),
-			longTime:          fmt.Sprintf("%02d:%02d:%02d %s", rec.Created.Hour(), rec.Created.Minute(), rec.Created.Second(), zone),
-			longDate:          fmt.Sprintf("%04d/%02d/%02d", rec.Created.Year(), rec.Created.Month(), rec.Created.Day()),
+		if len(literal) > 0 {
+			f.pieces = append(f.pieces, formatPiece{literal: string(literal)})
+			literal = literal[:0]
 		}
-		cache = *updated
-		formatCache = updated
+		f.pieces = append(f.pieces, piece)
+	}
+	if len(literal) > 0 {
+		f.pieces = append(f.pieces, formatPiece{literal: string(literal)})
+	}
+	return f
+}
+
+// String returns the format string f was compiled from.
+func (f *CompiledFormat) String() string {
+	return f.format
+}
+
+// SetLocation sets the time zone in which times are formatted (chainable).  A
+// nil location, the default, uses the zone of each record's Created time.
+// Must be called before the first log message is formatted.
+func (f *CompiledFormat) SetLocation(loc *time.Location) *CompiledFormat {
+	f.location = loc
+	return f
+}
+
+// times returns the cached time and date strings for t, updating the cache if
+// t is in a different second or zone.
+func (f *CompiledFormat) times(t time.Time) *formatCacheType {
+	cache, _ := f.cache.Load().(*formatCacheType)
+	if cache != nil && cache.LastUpdateSeconds == t.Unix() && cache.location == t.Location() {
+		return cache
+	}
+	zone, _ := t.Zone()
+	cache = &formatCacheType{
+		LastUpdateSeconds: t.Unix(),
+		location:          t.Location(),
+		shortTime:         fmt.Sprintf("%02d:%02d", t.Hour(), t.Minute()),
+		shortDate:         fmt.Sprintf("%02d/%02d/%02d", t.Month(), t.Day(), t.Year()%100),
+		longTime:          fmt.Sprintf("%02d:%02d:%02d %s", t.Hour(), t.Minute(), t.Second(), zone),
+		longDate:          fmt.Sprintf("%04d/%02d/%02d", t.Year(), t.Month(), t.Day()),
 	}
+	f.cache.Store(cache)
+	return cache
+}
 
-	// Split the string into pieces by % signs
-	pieces := bytes.Split([]byte(format), []byte{'%'})
+// Format appends rec, formatted as FormatLogRecord would, to buf and returns
+// the extended buffer.
+func (f *CompiledFormat) Format(buf []byte, rec *LogRecord) []byte {
+	return f.appendRecord(buf, rec, nil)
+}
+
+// appendRecord formats rec, with %C using the given palette, or producing
+// nothing if it is nil.
+func (f *CompiledFormat) appendRecord(buf []byte, rec *LogRecord, palette *Palette) []byte {
+	if rec == nil {
+		return append(buf, "<nil>"...)
+	}
+	if len(f.format) == 0 {
+		return buf
+	}
 
-	// Iterate over the pieces, replacing known formats
-	for i, piece := range pieces {
-		if i > 0 && len(piece) > 0 {
-			switch piece[0] {
+	created := rec.Created
+	if f.location != nil {
+		created = created.In(f.location)
+	}
+	var cache *formatCacheType
+	colored := false
+
+	for _, piece := range f.pieces {
+		switch piece.verb {
+		case 0:
+			buf = append(buf, piece.literal...)
+			continue
+		case 'C':
+			if palette != nil {
+				color := palette.color(rec.Level)
+				buf = append(buf, color...)
+				colored = colored || color != ""
+			}
+			continue
+		case 'c':
+			if colored {
+				buf = append(buf, colorReset...)
+				colored = false
+			}
+			continue
+		}
+		start := len(buf)
+		switch piece.verb {
+		case 'T', 't', 'D', 'd':
+			if piece.literal != "" {
+				buf = created.AppendFormat(buf, piece.literal)
+				break
+			}
+			if cache == nil {
+				cache = f.times(created)
+			}
+			switch piece.verb {
 			case 'T':
-				out.WriteString(cache.longTime)
+				buf = append(buf, cache.longTime...)
 			case 't':
-				out.WriteString(cache.shortTime)
+				buf = append(buf, cache.shortTime...)
 			case 'D':
-				out.WriteString(cache.longDate)
+				buf = append(buf, cache.longDate...)
 			case 'd':
-				out.WriteString(cache.shortDate)
-			case 'L':
-				out.WriteString(levelStrings[rec.Level])
-			case 'S':
-				out.WriteString(rec.Source)
-			case 'M':
-				out.WriteString(rec.Message)
+				buf = append(buf, cache.shortDate...)
 			}
-			if len(piece) > 1 {
-				out.Write(piece[1:])
+		case 'm':
+			buf = appendZeroPadded(buf, rec.Created.Nanosecond()/1e6, 3)
+		case 'u':
+			buf = appendZeroPadded(buf, rec.Created.Nanosecond()/1e3, 6)
+		case 'n':
+			buf = appendZeroPadded(buf, rec.Created.Nanosecond(), 9)
+		case 'L':
+			buf = append(buf, levelStrings[rec.Level]...)
+		case 'V':
+			buf = append(buf, levelFullStrings[rec.Level]...)
+		case 'S':
+			buf = append(buf, rec.Source...)
+		case 'F':
+			if rec.File == "" {
+				buf = append(buf, rec.Source...)
+				break
 			}
-		} else if len(piece) > 0 {
-			out.Write(piece)
+			buf = append(buf, filepath.Base(rec.File)...)
+			buf = append(buf, ':')
+			buf = strconv.AppendInt(buf, int64(rec.Line), 10)
+		case 'f':
+			buf = append(buf, rec.File...)
+		case 'N':
+			buf = strconv.AppendInt(buf, int64(rec.Line), 10)
+		case 'G':
+			buf = strconv.AppendInt(buf, rec.Goroutine, 10)
+		case 'P':
+			buf = append(buf, formatPid...)
+		case 'H':
+			buf = append(buf, formatHostname...)
+		case 'p':
+			buf = append(buf, rec.Prefix...)
+		case 'M':
+			buf = append(buf, rec.Message...)
+		case 'X':
+			buf = rec.Fields.appendTo(buf)
 		}
+		buf = piece.adjust(buf, start)
+	}
+	if colored {
+		buf = append(buf, colorReset...)
 	}
-	out.WriteByte('\n')
+	return append(buf, '\n')
+}
 
-	return out.String()
+// appendZeroPadded appends the non-negative n with at least width digits.
+func appendZeroPadded(buf []byte, n, width int) []byte {
+	var digits [20]byte
+	i := len(digits)
+	for n >= 10 || width > 1 {
+		i--
+		digits[i] = byte('0' + n%10)
+		n /= 10
+		width--
+	}
+	i--
+	digits[i] = byte('0' + n)
+	return append(buf, digits[i:]...)
+}
+
+// The format codes understood by FormatLogRecord
+const formatVerbs = "TtDdmunLVSFfNGPHpMXCc"
+
+// adjust applies the piece's width and maximum length to the value which was
+// appended to buf starting at start.
+func (p formatPiece) adjust(buf []byte, start int) []byte {
+	if p.width == 0 && p.max < 0 {
+		return buf
+	}
+	n := utf8.RuneCount(buf[start:])
+
+	if p.max >= 0 && n > p.max {
+		value := buf[start:]
+		switch p.verb {
+		case 'S', 'F', 'f':
+			// Keep the end of sources, which is the most specific part
+			cut := 0
+			for skip := n - p.max; skip > 0; skip-- {
+				_, size := utf8.DecodeRune(value[cut:])
+				cut += size
+			}
+			buf = buf[:start+copy(value, value[cut:])]
+		default:
+			keep := 0
+			for i := 0; i < p.max; i++ {
+				_, size := utf8.DecodeRune(value[keep:])
+				keep += size
+			}
+			buf = buf[:start+keep]
+		}
+		n = p.max
+	}
+
+	if pad := p.width - n; pad > 0 {
+		end := len(buf)
+		for i := 0; i < pad; i++ {
+			buf = append(buf, ' ')
+		}
+		if !p.left {
+			copy(buf[start+pad:], buf[start:end])
+			for i := start; i < start+pad; i++ {
+				buf[i] = ' '
+			}
+		}
+	}
+	return buf
 }
 
 // This is the standard writer that prints to standard output.
-type FormatLogWriter chan *LogRecord
+type FormatLogWriter struct {
+	*logQueue
+	formatter Formatter
+}
 
 // This creates a new FormatLogWriter
-func NewFormatLogWriter(out io.Writer, format string) FormatLogWriter {
-	records := make(FormatLogWriter, LogBufferLength)
-	go records.run(out, format)
-	return records
-}
+func NewFormatLogWriter(out io.Writer, format string) *FormatLogWriter {
+	w := &FormatLogWriter{
+		logQueue:  newLogQueue(),
+		formatter: CompileFormat(format),
+	}
 
-func (w FormatLogWriter) run(out io.Writer, format string) {
-	for rec := range w {
-		fmt.Fprint(out, FormatLogRecord(format, rec))
+	var buf []byte
+	write := func(rec *LogRecord) error {
+		buf = w.formatter.Format(buf[:0], rec)
+		_, err := out.Write(buf)
+		return err
+	}
+	sync := func() error {
+		return syncOutput(out)
 	}
+
+	w.start("FormatLogWriter", write, sync, nil)
+	return w
+}
+
+// This is the FormatLogWriter's output method.  If the output buffer is full,
+// this blocks or not according to the overflow policy.
+func (w *FormatLogWriter) LogWrite(rec *LogRecord) {
+	w.put(rec)
+}
+
+// Close stops the logger from sending messages to standard output, and returns
+// once the messages already sent have been written.  Attempts to send log
+// messages to this logger after a Close have undefined behavior.
+func (w *FormatLogWriter) Close() {
+	w.close()
+}
+
+// Flush waits until the messages already sent have been written and, if the
+// output is a file, synced to stable storage, or until ctx is done.
+func (w *FormatLogWriter) Flush(ctx context.Context) error {
+	return w.flush(ctx)
+}
+
+// SetFormatter replaces the format given to NewFormatLogWriter with any
+// Formatter (chainable).  Must be called before the first log message is
+// written.
+func (w *FormatLogWriter) SetFormatter(formatter Formatter) *FormatLogWriter {
+	w.formatter = formatter
+	return w
+}
+
+// wantsGoroutine reports whether the records need the id of the goroutine
+// which logged them.
+func (w *FormatLogWriter) wantsGoroutine() bool {
+	return formatsGoroutine(w.formatter)
+}
+
+// SetOverflowPolicy sets what happens to records logged while the output
+// buffer is full (chainable).  The fallback LogWriter is only used by
+// OverflowSpill, and is not closed by this writer.  Must be called before the
+// first log message is written.
+func (w *FormatLogWriter) SetOverflowPolicy(policy OverflowPolicy, fallback LogWriter) *FormatLogWriter {
+	w.policy, w.fallback = policy, fallback
+	return w
+}
+
+// OverflowStats returns the number of records which could not be buffered.
+func (w *FormatLogWriter) OverflowStats() OverflowStats {
+	return w.stats()
 }
 
-// This is the FormatLogWriter's output method.  This will block if the output
-// buffer is full.
-func (w FormatLogWriter) LogWrite(rec *LogRecord) {
-	w <- rec
+// SetErrorHandler sets a function to call with the errors from writing
+// records, instead of printing them to standard error (chainable).  It is
+// called from the writing goroutine, and must not log to this writer.  Must
+// be called before the first log message is written.
+func (w *FormatLogWriter) SetErrorHandler(handler func(err error)) *FormatLogWriter {
+	w.onError = handler
+	return w
 }
 
-// Close stops the logger from sending messages to standard output.  Attempts to
-// send log messages to this logger after a Close have undefined behavior.
-func (w FormatLogWriter) Close() {
-	close(w)
+// SetRetryPolicy sets how failed writes are retried before records fall back
+// to standard error (chainable).  Must be called before the first log message
+// is written.
+func (w *FormatLogWriter) SetRetryPolicy(policy RetryPolicy) *FormatLogWriter {
+	w.retry = policy
+	return w
 }
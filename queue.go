@@ -0,0 +1,341 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// An OverflowPolicy determines what a LogWriter does with a record when its
+// buffer of LogBufferLength records is full.
+type OverflowPolicy int
+
+const (
+	OverflowBlock      OverflowPolicy = iota // Wait for room in the buffer (the default)
+	OverflowDropNewest                       // Discard the record being written
+	OverflowDropOldest                       // Discard the oldest buffered record to make room
+	OverflowSpill                            // Send the record to a fallback LogWriter instead
+)
+
+var overflowPolicyStrings = [...]string{"block", "dropnewest", "dropoldest", "spill"}
+
+func (p OverflowPolicy) String() string {
+	if p < 0 || int(p) >= len(overflowPolicyStrings) {
+		return "unknown"
+	}
+	return overflowPolicyStrings[p]
+}
+
+// OverflowStats counts the records a LogWriter could not buffer.
+type OverflowStats struct {
+	Dropped uint64 // Records which were discarded
+	Spilled uint64 // Records which were sent to the fallback LogWriter
+}
+
+// A RetryPolicy determines how a LogWriter retries a record which it failed
+// to write.  Once the retries are used up, the error is reported and the
+// writer falls back to writing records to standard error, trying its own
+// output again after Backoff, then twice that, and so on up to MaxBackoff.
+// The zero RetryPolicy does not retry, and tries the output again after one
+// second, backing off to a minute.
+type RetryPolicy struct {
+	Attempts   int           // Retries of a failed record before falling back
+	Backoff    time.Duration // Wait before the first retry, doubling after each
+	MaxBackoff time.Duration // Longest wait between attempts
+}
+
+// backoff returns the wait before attempt n (from 0), and the default for
+// when no Backoff is set.
+func (p RetryPolicy) backoff(n int, def time.Duration) time.Duration {
+	wait, max := p.Backoff, p.MaxBackoff
+	if wait <= 0 {
+		wait = def
+	}
+	if max <= 0 {
+		max = time.Minute
+	}
+	for ; n > 0 && wait < max; n-- {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// A logQueue is the buffer between the goroutines calling LogWrite and the
+// goroutine which does the writing.  It is shared by all of the built-in
+// LogWriters.
+type logQueue struct {
+	dropped, spilled uint64 // Updated atomically; keep first for alignment
+
+	rec  chan *LogRecord
+	ctl  chan func() error // Requests run by the writing goroutine in order
+	done chan bool         // Closed when the writing goroutine exits
+
+	// Set by start and used only by the writing goroutine
+	name  string
+	write func(rec *LogRecord) error
+	sync  func() error
+
+	policy   OverflowPolicy
+	fallback LogWriter
+
+	// Counts as of the last overflow report (owned by the writing goroutine)
+	reported OverflowStats
+
+	// Error handling
+	onError func(err error)
+	retry   RetryPolicy
+	errMu   sync.Mutex // Serializes reports from background work
+
+	// Set while writing to standard error after a failure (owned by the
+	// writing goroutine)
+	degraded bool
+	failures int
+	retryAt  time.Time
+
+	// Set by write when the record was written but could not be committed,
+	// so that retrying it does not write it again.  Cleared by writeOne once
+	// it is done with the record.
+	written bool
+}
+
+func newLogQueue() *logQueue {
+	return &logQueue{
+		rec:  make(chan *LogRecord, LogBufferLength),
+		ctl:  make(chan func() error),
+		done: make(chan bool),
+	}
+}
+
+// start launches the writing goroutine, which passes each queued record to
+// write and calls finish (if not nil) once the queue is closed.  The name is
+// used in error messages.  If write returns an error, the record is retried
+// and then written to standard error according to the retry policy, and the
+// error is passed to the error handler.  The sync function (if not nil) is
+// used by flush to commit written records to stable storage.
+func (q *logQueue) start(name string, write func(rec *LogRecord) error, sync func() error, finish func()) {
+	q.name, q.write, q.sync = name, write, sync
+	go func() {
+		defer close(q.done)
+		if finish != nil {
+			defer finish()
+		}
+		q.run()
+	}()
+}
+
+func (q *logQueue) run() {
+	for {
+		select {
+		case rec, ok := <-q.rec:
+			if !ok {
+				return
+			}
+			q.writeRecord(rec)
+		case fn := <-q.ctl:
+			// Write the records queued ahead of the request first.  Records
+			// may also be taken by OverflowDropOldest, so don't wait for them.
+		drain:
+			for n := len(q.rec); n > 0; n-- {
+				select {
+				case rec, ok := <-q.rec:
+					if !ok {
+						break drain
+					}
+					q.writeRecord(rec)
+				default:
+					break drain
+				}
+			}
+			if err := fn(); err != nil {
+				q.reportError(err)
+			}
+		}
+	}
+}
+
+// writeRecord writes rec, followed by an overflow report if one is due.
+func (q *logQueue) writeRecord(rec *LogRecord) {
+	q.writeOne(rec)
+	if report := q.overflowReport(); report != nil {
+		q.writeOne(report)
+	}
+}
+
+// writeOne writes rec, retrying and then falling back to standard error if
+// that fails.
+func (q *logQueue) writeOne(rec *LogRecord) {
+	if q.degraded && time.Now().Before(q.retryAt) {
+		q.writeStderr(rec)
+		return
+	}
+
+	err := q.write(rec)
+	for n := 0; err != nil && !q.degraded && n < q.retry.Attempts; n++ {
+		time.Sleep(q.retry.backoff(n, 10*time.Millisecond))
+		err = q.write(rec)
+	}
+	q.written = false
+	if err == nil {
+		q.degraded, q.failures = false, 0
+		return
+	}
+
+	q.reportError(err)
+	q.retryAt = time.Now().Add(q.retry.backoff(q.failures, time.Second))
+	q.degraded = true
+	q.failures++
+	q.writeStderr(rec)
+}
+
+// writeStderr writes rec to standard error, for when the output has failed.
+func (q *logQueue) writeStderr(rec *LogRecord) {
+	io.WriteString(stderr, FormatLogRecord(FORMAT_DEFAULT, rec))
+}
+
+// reportError passes err to the error handler, or if there is none, writes it
+// to standard error.  It may be called from any goroutine.
+func (q *logQueue) reportError(err error) {
+	q.errMu.Lock()
+	defer q.errMu.Unlock()
+	if q.onError != nil {
+		q.onError(err)
+		return
+	}
+	fmt.Fprintf(stderr, "%s: %s\n", q.name, err)
+}
+
+var errWriterStopped = errors.New("log4go: LogWriter has stopped")
+
+// control has the writing goroutine call fn once the records already queued
+// have been written.  It returns without waiting for fn to run.
+func (q *logQueue) control(ctx context.Context, fn func() error) error {
+	select {
+	case q.ctl <- fn:
+		return nil
+	case <-q.done:
+		return errWriterStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush waits until the records already queued have been written and synced,
+// or ctx is done.
+func (q *logQueue) flush(ctx context.Context) error {
+	result := make(chan error, 1)
+	err := q.control(ctx, func() error {
+		if q.sync == nil {
+			result <- nil
+		} else {
+			result <- q.sync()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-q.done:
+		return errWriterStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// put queues rec for writing, applying the overflow policy if the buffer is
+// full.
+func (q *logQueue) put(rec *LogRecord) {
+	if q.policy == OverflowBlock {
+		q.rec <- rec
+		return
+	}
+	for {
+		select {
+		case q.rec <- rec:
+			return
+		default:
+		}
+
+		switch q.policy {
+		case OverflowDropOldest:
+			if cap(q.rec) > 0 {
+				select {
+				case <-q.rec:
+					atomic.AddUint64(&q.dropped, 1)
+				default:
+				}
+				continue
+			}
+		case OverflowSpill:
+			if q.fallback != nil {
+				atomic.AddUint64(&q.spilled, 1)
+				q.fallback.LogWrite(rec)
+				return
+			}
+		}
+		atomic.AddUint64(&q.dropped, 1)
+		return
+	}
+}
+
+// close stops the queue and waits for the writing goroutine to finish.
+func (q *logQueue) close() {
+	close(q.rec)
+	<-q.done
+}
+
+func (q *logQueue) stats() OverflowStats {
+	return OverflowStats{
+		Dropped: atomic.LoadUint64(&q.dropped),
+		Spilled: atomic.LoadUint64(&q.spilled),
+	}
+}
+
+// syncOutput commits out to stable storage, if it is something (like an
+// *os.File) which supports that.  Outputs which cannot be synced, such as
+// terminals and pipes, are not treated as an error.
+func syncOutput(out io.Writer) error {
+	s, ok := out.(interface {
+		Sync() error
+	})
+	if !ok {
+		return nil
+	}
+	if err := s.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+	return nil
+}
+
+// overflowReport returns a record describing the records lost since the last
+// report, or nil if there were none or the buffer is still backed up.  It must
+// only be called by the writing goroutine.
+func (q *logQueue) overflowReport() *LogRecord {
+	if len(q.rec) > 0 {
+		return nil
+	}
+	stats := q.stats()
+	if stats == q.reported {
+		return nil
+	}
+	dropped, spilled := stats.Dropped-q.reported.Dropped, stats.Spilled-q.reported.Spilled
+	q.reported = stats
+	return &LogRecord{
+		Level:   WARNING,
+		Created: time.Now(),
+		Source:  "log4go",
+		Message: fmt.Sprintf("log buffer overflowed: %d records dropped, %d records spilled", dropped, spilled),
+	}
+}
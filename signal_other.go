@@ -0,0 +1,16 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build windows || plan9
+// +build windows plan9
+
+package log4go
+
+import (
+	"os"
+)
+
+// There are no signals for ReopenOnSignal to listen for by default
+var reopenSignals []os.Signal
+
+// The signals which may be named by the XML reopensignal property
+var signalNames = map[string]os.Signal{}
@@ -0,0 +1,21 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package log4go
+
+import (
+	"os"
+	"syscall"
+)
+
+// The signals ReopenOnSignal listens for by default
+var reopenSignals = []os.Signal{syscall.SIGHUP}
+
+// The signals which may be named by the XML reopensignal property
+var signalNames = map[string]os.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
@@ -3,55 +3,122 @@
 package log4go
 
 import (
-	"os"
+	"context"
 	"fmt"
 	"net"
-	"encoding/json"
 )
 
 // This log writer sends output to a socket
-type SocketLogWriter chan *LogRecord
+type SocketLogWriter struct {
+	*logQueue
+	formatter Formatter
+}
 
 // This is the SocketLogWriter's output method
-func (w SocketLogWriter) LogWrite(rec *LogRecord) {
-	w <- rec
+func (w *SocketLogWriter) LogWrite(rec *LogRecord) {
+	w.put(rec)
+}
+
+// Close stops the writer and returns once the records already sent have been
+// written to the socket.
+func (w *SocketLogWriter) Close() {
+	w.close()
+}
+
+// Flush waits until the records already sent have been written to the
+// socket, or ctx is done.
+func (w *SocketLogWriter) Flush(ctx context.Context) error {
+	return w.flush(ctx)
+}
+
+// SetFormatter sets the Formatter used to render records (chainable).  By
+// default each record is sent as a JSON object.  Must be called before the
+// first log message is written.
+func (w *SocketLogWriter) SetFormatter(formatter Formatter) *SocketLogWriter {
+	w.formatter = formatter
+	return w
+}
+
+// wantsGoroutine reports whether the records need the id of the goroutine
+// which logged them.
+func (w *SocketLogWriter) wantsGoroutine() bool {
+	return formatsGoroutine(w.formatter)
+}
+
+// SetOverflowPolicy sets what happens to records logged while the output
+// buffer is full (chainable).  The fallback LogWriter is only used by
+// OverflowSpill, and is not closed by this writer.  Must be called before the
+// first log message is written.
+func (w *SocketLogWriter) SetOverflowPolicy(policy OverflowPolicy, fallback LogWriter) *SocketLogWriter {
+	w.policy, w.fallback = policy, fallback
+	return w
+}
+
+// OverflowStats returns the number of records which could not be buffered.
+func (w *SocketLogWriter) OverflowStats() OverflowStats {
+	return w.stats()
 }
 
-func (w SocketLogWriter) Close() {
-	close(w)
+// SetErrorHandler sets a function to call with the errors from writing
+// records, instead of printing them to standard error (chainable).  It is
+// called from the writing goroutine, and must not log to this writer.  Must
+// be called before the first log message is written.
+func (w *SocketLogWriter) SetErrorHandler(handler func(err error)) *SocketLogWriter {
+	w.onError = handler
+	return w
+}
+
+// SetRetryPolicy sets how failed writes are retried before records fall back
+// to standard error (chainable).  Must be called before the first log message
+// is written.
+func (w *SocketLogWriter) SetRetryPolicy(policy RetryPolicy) *SocketLogWriter {
+	w.retry = policy
+	return w
 }
 
-func NewSocketLogWriter(proto, hostport string) SocketLogWriter {
+// NewSocketLogWriter creates a SocketLogWriter which sends each record to
+// hostport over proto ("tcp" or "udp").  If it cannot connect, or the
+// connection breaks, the error is handled as any write error, and it dials
+// again for the next record it tries to send.
+func NewSocketLogWriter(proto, hostport string) *SocketLogWriter {
 	sock, err := net.Dial(proto, hostport)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewSocketLogWriter(%q): %s\n", hostport, err)
-		return nil
+		fmt.Fprintf(stderr, "NewSocketLogWriter(%q): %s\n", hostport, err)
+		sock = nil
 	}
 
-	w := SocketLogWriter(make(chan *LogRecord, LogBufferLength))
-
-	go func() {
-		defer func() {
-			if sock != nil && proto == "tcp" {
-				sock.Close()
-			}
-		}()
-
-		for rec := range w {
-			// Marshall into JSON
-			js, err := json.Marshal(rec)
-			if err != nil {
-				fmt.Fprint(os.Stderr, "SocketLogWriter(%q): %s", hostport, err)
-				return
-			}
+	w := &SocketLogWriter{
+		logQueue:  newLogQueue(),
+		formatter: socketFormatter{},
+	}
 
-			_, err = sock.Write(js)
-			if err != nil {
-				fmt.Fprint(os.Stderr, "SocketLogWriter(%q): %s", hostport, err)
-				return
+	// Each record is sent with a single Write (one datagram for UDP)
+	var buf []byte
+	write := func(rec *LogRecord) error {
+		buf = w.formatter.Format(buf[:0], rec)
+		if len(buf) == 0 {
+			return nil
+		}
+		if sock == nil {
+			var err error
+			if sock, err = net.Dial(proto, hostport); err != nil {
+				sock = nil
+				return err
 			}
 		}
-	}()
+		if _, err := sock.Write(buf); err != nil {
+			sock.Close()
+			sock = nil
+			return err
+		}
+		return nil
+	}
+	finish := func() {
+		if sock != nil && proto == "tcp" {
+			sock.Close()
+		}
+	}
 
+	w.start(fmt.Sprintf("SocketLogWriter(%q)", hostport), write, nil, finish)
 	return w
 }
@@ -3,6 +3,7 @@
 package log4go
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -22,15 +23,71 @@ const (
 )
 
 // This log writer sends output to a socket
-type SysLogWriter chan *LogRecord
+type SysLogWriter struct {
+	*logQueue
+	formatter Formatter
+}
 
 // This is the SocketLogWriter's output method
-func (w SysLogWriter) LogWrite(rec *LogRecord) {
-	w <- rec
+func (w *SysLogWriter) LogWrite(rec *LogRecord) {
+	w.put(rec)
+}
+
+// Close stops the writer and returns once the records already sent have been
+// passed to the syslog daemon.
+func (w *SysLogWriter) Close() {
+	w.close()
+}
+
+// Flush waits until the records already sent have been passed to the syslog
+// daemon, or ctx is done.
+func (w *SysLogWriter) Flush(ctx context.Context) error {
+	return w.flush(ctx)
 }
 
-func (w SysLogWriter) Close() {
-	close(w)
+// SetFormatter sets the Formatter used to render the MSG part of each syslog
+// message (chainable).  The default is the pattern "%M".  Must be called before
+// the first log message is written.
+func (w *SysLogWriter) SetFormatter(formatter Formatter) *SysLogWriter {
+	w.formatter = formatter
+	return w
+}
+
+// wantsGoroutine reports whether the records need the id of the goroutine
+// which logged them.
+func (w *SysLogWriter) wantsGoroutine() bool {
+	return formatsGoroutine(w.formatter)
+}
+
+// SetOverflowPolicy sets what happens to records logged while the output
+// buffer is full (chainable).  The fallback LogWriter is only used by
+// OverflowSpill, and is not closed by this writer.  Must be called before the
+// first log message is written.
+func (w *SysLogWriter) SetOverflowPolicy(policy OverflowPolicy, fallback LogWriter) *SysLogWriter {
+	w.policy, w.fallback = policy, fallback
+	return w
+}
+
+// OverflowStats returns the number of records which could not be buffered.
+func (w *SysLogWriter) OverflowStats() OverflowStats {
+	return w.stats()
+}
+
+// SetErrorHandler sets a function to call with the errors from writing
+// records, instead of printing them to standard error (chainable).  It is
+// called from the writing goroutine, and must not log to this writer.  Must
+// be called before the first log message is written.
+func (w *SysLogWriter) SetErrorHandler(handler func(err error)) *SysLogWriter {
+	w.onError = handler
+	return w
+}
+
+// SetRetryPolicy sets how failed writes are retried before records fall back
+// to standard error (chainable).  Must be called before the first log message
+// is written.
+func (w *SysLogWriter) SetRetryPolicy(policy RetryPolicy) *SysLogWriter {
+	w.retry = policy
+	return w
 }
 
 func connectSyslogDaemon() (sock net.Conn, err error) {
@@ -55,7 +112,59 @@ func connectSyslogDaemon() (sock net.Conn, err error) {
 	return
 }
 
-func NewSysLogWriter(facility int) (w SysLogWriter) {
+// SysLogSDID is the SD-ID under which structured fields are sent in the RFC
+// 5424 STRUCTURED-DATA element of each message.
+var SysLogSDID = "fields@32473"
+
+// syslogStructuredData renders fields as an RFC 5424 SD-ELEMENT, or the NILVALUE
+// "-" if there are none.
+func syslogStructuredData(fields Fields) string {
+	if len(fields) == 0 {
+		return "-"
+	}
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '[')
+	buf = append(buf, SysLogSDID...)
+	for _, field := range fields {
+		buf = append(buf, ' ')
+		buf = appendSDName(buf, field.Key)
+		buf = append(buf, '=', '"')
+		for _, r := range fmt.Sprint(field.Value) {
+			switch r {
+			case '"', '\\', ']':
+				buf = append(buf, '\\')
+			}
+			buf = append(buf, string(r)...)
+		}
+		buf = append(buf, '"')
+	}
+	return string(append(buf, ']'))
+}
+
+// appendSDName appends key as an RFC 5424 PARAM-NAME: at most 32 printable
+// US-ASCII characters other than '=', ' ', ']' and '"'.
+func appendSDName(buf []byte, key string) []byte {
+	n := 0
+	for i := 0; i < len(key) && n < 32; i++ {
+		c := key[i]
+		if c <= ' ' || c >= 0x7f || c == '=' || c == ']' || c == '"' {
+			c = '_'
+		}
+		buf = append(buf, c)
+		n++
+	}
+	if n == 0 {
+		buf = append(buf, '_')
+	}
+	return buf
+}
+
+// NewSysLogWriter creates a SysLogWriter which sends RFC 5424 formatted
+// messages to the local syslog daemon using the given facility.  Structured
+// fields are sent as STRUCTURED-DATA under SysLogSDID.  If there is no daemon
+// to connect to, or the connection breaks, the error is handled as any write
+// error, and it connects again for the next record it tries to send.
+func NewSysLogWriter(facility int) (w *SysLogWriter) {
 	offset := facility * 8
 	host, err := os.Hostname()
 	if err != nil {
@@ -64,25 +173,49 @@ func NewSysLogWriter(facility int) (w SysLogWriter) {
 	}
 	sock, err := connectSyslogDaemon()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewSysLogWriter: %s\n", err.Error())
-		return
+		fmt.Fprintf(stderr, "NewSysLogWriter: %s\n", err.Error())
+		sock = nil
 	}
-	w = SysLogWriter(make(chan *LogRecord, LogBufferLength))
-	go func() {
-		defer func() {
-			if sock != nil {
-				sock.Close()
-			}
-		}()
-		var timestr string
-		var timestrAt int64
-		for rec := range w {
-			if rec.Created.Unix() != timestrAt {
-				timestrAt = rec.Created.Unix()
-				timestr = time.Unix(timestrAt, 0).UTC().Format(time.RFC3339)
+	w = &SysLogWriter{
+		logQueue:  newLogQueue(),
+		formatter: CompileFormat("%M"),
+	}
+
+	var timestr string
+	var timestrAt int64
+	var buf []byte
+	pid := os.Getpid()
+	write := func(rec *LogRecord) error {
+		if rec.Created.Unix() != timestrAt {
+			timestrAt = rec.Created.Unix()
+			timestr = time.Unix(timestrAt, 0).UTC().Format(time.RFC3339)
+		}
+		app := rec.Prefix
+		if app == "" {
+			app = "-"
+		}
+		buf = append(buf[:0], fmt.Sprintf("<%d>1 %s %s %s %d - %s ", offset+int(rec.Level), timestr, host, app, pid, syslogStructuredData(rec.Fields))...)
+		buf = w.formatter.Format(buf, rec)
+		if sock == nil {
+			var err error
+			if sock, err = connectSyslogDaemon(); err != nil {
+				sock = nil
+				return err
 			}
-			fmt.Fprintf(sock, "<%d>%s %s %s: %s\n", offset+int(rec.Level), timestr, host, rec.Prefix, rec.Message)
 		}
-	}()
+		if _, err := sock.Write(buf); err != nil {
+			sock.Close()
+			sock = nil
+			return err
+		}
+		return nil
+	}
+	finish := func() {
+		if sock != nil {
+			sock.Close()
+		}
+	}
+
+	w.start("SysLogWriter", write, nil, finish)
 	return
 }
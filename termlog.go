@@ -3,44 +3,254 @@
 package log4go
 
 import (
+	"context"
 	"io"
 	"os"
-	"fmt"
-	"time"
 )
 
-var stdout io.Writer = os.Stdout
+var (
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
+// A ColorMode determines whether a ConsoleLogWriter colors its output.
+type ColorMode int
+
+const (
+	ColorAuto   ColorMode = iota // Color when writing to a terminal, unless NO_COLOR is set (the default)
+	ColorAlways                  // Always color
+	ColorNever                   // Never color
+)
+
+var colorModeStrings = [...]string{"auto", "always", "never"}
+
+func (m ColorMode) String() string {
+	if m < 0 || int(m) >= len(colorModeStrings) {
+		return "unknown"
+	}
+	return colorModeStrings[m]
+}
+
+// enabled reports whether output to out should be colored.
+func (m ColorMode) enabled(out io.Writer) bool {
+	switch m {
+	case ColorAlways:
+		return true
+	case ColorNever:
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	f, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// A Palette holds the ANSI escape sequence which starts the color for each
+// LogLevel.  Levels with an empty sequence are not colored.
+type Palette [DEBUG + 1]string
+
+// DefaultPalette colors ERROR and above red (bold for CRITICAL and above),
+// WARNING yellow and DEBUG dim.
+var DefaultPalette = Palette{
+	EMERGENCY: "\x1b[1;31m",
+	ALERT:     "\x1b[1;31m",
+	CRITICAL:  "\x1b[1;31m",
+	ERROR:     "\x1b[31m",
+	WARNING:   "\x1b[33m",
+	DEBUG:     "\x1b[2m",
+}
+
+// The ANSI escape sequence which ends a color
+const colorReset = "\x1b[0m"
+
+func (p *Palette) color(lvl LogLevel) string {
+	if lvl < 0 || int(lvl) >= len(p) {
+		return ""
+	}
+	return p[lvl]
+}
+
+// formatColor formats rec with f, colored according to palette unless it is
+// nil.  A CompiledFormat which uses %C places the color itself; the output of
+// any other Formatter is colored as a whole.
+func formatColor(f Formatter, buf []byte, rec *LogRecord, palette *Palette) []byte {
+	if palette == nil {
+		return f.Format(buf, rec)
+	}
+	if cf, ok := f.(*CompiledFormat); ok && cf.colored {
+		return cf.appendRecord(buf, rec, palette)
+	}
+
+	start := len(buf)
+	buf = f.Format(buf, rec)
+	color := palette.color(rec.Level)
+	if color == "" || len(buf) == start {
+		return buf
+	}
+	end := len(buf)
+	buf = append(buf, color...)
+	copy(buf[start+len(color):], buf[start:end])
+	copy(buf[start:], color)
+	if buf[len(buf)-1] == '\n' {
+		buf = append(buf[:len(buf)-1], colorReset...)
+		return append(buf, '\n')
+	}
+	return append(buf, colorReset...)
+}
 
 // This is the standard writer that prints to standard output.
-type ConsoleLogWriter chan *LogRecord
+type ConsoleLogWriter struct {
+	*logQueue
+	formatter Formatter
+	color     ColorMode
+	palette   Palette
+	errLevel  LogLevel // Records at this level or more severe go to errOut
+}
 
 // This creates a new ConsoleLogWriter
-func NewConsoleLogWriter() ConsoleLogWriter {
-	records := make(ConsoleLogWriter, LogBufferLength)
-	go records.run(stdout)
-	return records
+func NewConsoleLogWriter() *ConsoleLogWriter {
+	return newConsoleLogWriter(stdout, stderr)
 }
 
-func (w ConsoleLogWriter) run(out io.Writer) {
-	var timestr string
-	var timestrAt int64
+// NewSplitConsoleLogWriter creates a ConsoleLogWriter which writes WARNING and
+// more severe records to standard error, and the rest to standard output.
+func NewSplitConsoleLogWriter() *ConsoleLogWriter {
+	return NewConsoleLogWriter().SetStderrLevel(WARNING)
+}
+
+func newConsoleLogWriter(out, errOut io.Writer) *ConsoleLogWriter {
+	w := &ConsoleLogWriter{
+		logQueue:  newLogQueue(),
+		formatter: consoleFormatter{},
+		palette:   DefaultPalette,
+		errLevel:  INGORE,
+	}
 
-	for rec := range w {
-		if rec.Created.Unix() != timestrAt {
-			timestr, timestrAt = rec.Created.Format(time.RFC1123), rec.Created.Unix()
+	// Both outputs are written by this goroutine, so records appear in order
+	// when they are sent to the same place (such as a container's log).
+	var buf []byte
+	var palette, errPalette *Palette // Set if the output is colored
+	decided := false
+	write := func(rec *LogRecord) error {
+		if !decided {
+			if w.color.enabled(out) {
+				palette = &w.palette
+			}
+			if w.color.enabled(errOut) {
+				errPalette = &w.palette
+			}
+			decided = true
+		}
+		if rec.Level <= w.errLevel {
+			buf = formatColor(w.formatter, buf[:0], rec, errPalette)
+			_, err := errOut.Write(buf)
+			return err
 		}
-		fmt.Fprint(out, levelStrings[rec.Level], " ", timestr, " ", rec.Prefix, ": ", rec.Message, "\n")
+		buf = formatColor(w.formatter, buf[:0], rec, palette)
+		_, err := out.Write(buf)
+		return err
 	}
+	sync := func() error {
+		syncOutput(out)
+		if w.errLevel != INGORE {
+			syncOutput(errOut)
+		}
+		return nil
+	}
+
+	w.start("ConsoleLogWriter", write, sync, nil)
+	return w
+}
+
+// This is the ConsoleLogWriter's output method.  If the output buffer is full,
+// this blocks or not according to the overflow policy.
+func (w *ConsoleLogWriter) LogWrite(rec *LogRecord) {
+	w.put(rec)
+}
+
+// Close stops the logger from sending messages to standard output, and returns
+// once the messages already sent have been written.  Attempts to send log
+// messages to this logger after a Close have undefined behavior.
+func (w *ConsoleLogWriter) Close() {
+	w.close()
+}
+
+// Flush waits until the messages already sent have been written, or ctx is
+// done.
+func (w *ConsoleLogWriter) Flush(ctx context.Context) error {
+	return w.flush(ctx)
+}
+
+// SetFormatter sets the Formatter used to render records (chainable).  Must
+// be called before the first log message is written.
+func (w *ConsoleLogWriter) SetFormatter(formatter Formatter) *ConsoleLogWriter {
+	w.formatter = formatter
+	return w
+}
+
+// wantsGoroutine reports whether the records need the id of the goroutine
+// which logged them.
+func (w *ConsoleLogWriter) wantsGoroutine() bool {
+	return formatsGoroutine(w.formatter)
+}
+
+// SetStderrLevel sends records at lvl or more severe to standard error
+// instead of standard output (chainable).  By default everything goes to
+// standard output; INGORE restores that.  Must be called before the first log
+// message is written.
+func (w *ConsoleLogWriter) SetStderrLevel(lvl LogLevel) *ConsoleLogWriter {
+	w.errLevel = lvl
+	return w
+}
+
+// SetColor sets whether records are colored by level (chainable).  By
+// default they are colored only if the output is a terminal and the
+// NO_COLOR environment variable is not set.  Must be called before the first
+// log message is written.
+func (w *ConsoleLogWriter) SetColor(mode ColorMode) *ConsoleLogWriter {
+	w.color = mode
+	return w
+}
+
+// SetPalette sets the colors used for each level (chainable).  Must be called
+// before the first log message is written.
+func (w *ConsoleLogWriter) SetPalette(palette Palette) *ConsoleLogWriter {
+	w.palette = palette
+	return w
+}
+
+// SetOverflowPolicy sets what happens to records logged while the output
+// buffer is full (chainable).  The fallback LogWriter is only used by
+// OverflowSpill, and is not closed by this writer.  Must be called before the
+// first log message is written.
+func (w *ConsoleLogWriter) SetOverflowPolicy(policy OverflowPolicy, fallback LogWriter) *ConsoleLogWriter {
+	w.policy, w.fallback = policy, fallback
+	return w
+}
+
+// OverflowStats returns the number of records which could not be buffered.
+func (w *ConsoleLogWriter) OverflowStats() OverflowStats {
+	return w.stats()
 }
 
-// This is the ConsoleLogWriter's output method.  This will block if the output
-// buffer is full.
-func (w ConsoleLogWriter) LogWrite(rec *LogRecord) {
-	w <- rec
+// SetErrorHandler sets a function to call with the errors from writing
+// records, instead of printing them to standard error (chainable).  It is
+// called from the writing goroutine, and must not log to this writer.  Must
+// be called before the first log message is written.
+func (w *ConsoleLogWriter) SetErrorHandler(handler func(err error)) *ConsoleLogWriter {
+	w.onError = handler
+	return w
 }
 
-// Close stops the logger from sending messages to standard output.  Attempts to
-// send log messages to this logger after a Close have undefined behavior.
-func (w ConsoleLogWriter) Close() {
-	close(w)
+// SetRetryPolicy sets how failed writes are retried before records fall back
+// to standard error (chainable).  Must be called before the first log message
+// is written.
+func (w *ConsoleLogWriter) SetRetryPolicy(policy RetryPolicy) *ConsoleLogWriter {
+	w.retry = policy
+	return w
 }
@@ -3,13 +3,24 @@
 package log4go
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -63,6 +74,71 @@ var formatTests = []struct {
 			FORMAT_ABBREV:  "[EROR] message\n",
 		},
 	},
+	{
+		Test: "Structured fields",
+		Record: &LogRecord{
+			Level:   INFO,
+			Source:  "log4go_test",
+			Message: "message",
+			Created: now,
+			Fields:  Fields{{"user", "kevlar"}, {"shard", 3}, {"note", "two words"}},
+		},
+		Formats: map[string]string{
+			"[%L] %M %X": "[INFO] message user=kevlar shard=3 note=\"two words\"\n",
+		},
+	},
+	{
+		Test: "Extended verbs",
+		Record: &LogRecord{
+			Level:     WARNING,
+			Source:    "main.main:12",
+			File:      "/src/app/main.go",
+			Line:      12,
+			Goroutine: 7,
+			Prefix:    "web",
+			Message:   "message",
+			Created:   now.Add(123456789),
+		},
+		Formats: map[string]string{
+			"%F|%f|%N|%G|%p|%V":    "main.go:12|/src/app/main.go|12|7|web|WARNING\n",
+			"%T.%m %T.%u %T.%n":    "23:31:30 UTC.123 23:31:30 UTC.123456 23:31:30 UTC.123456789\n",
+			"100%% %P %H %Q done%": "100% " + strconv.Itoa(os.Getpid()) + " " + hostname() + "  done\n",
+		},
+	},
+	{
+		Test: "Time layouts",
+		Record: &LogRecord{
+			Level:   INFO,
+			Message: "message",
+			Created: now.Add(123456789),
+		},
+		Formats: map[string]string{
+			"%{2006-01-02T15:04:05.000Z07:00}T %M": "2009-02-13T23:31:30.123Z message\n",
+			"[%-10{15:04}T][%{Jan 2}T]":            "[23:31     ][Feb 13]\n",
+			"%{unclosed": "\n",
+			"%{x}Q%T":    "23:31:30 UTC\n",
+		},
+	},
+	{
+		Test: "Width and truncation",
+		Record: &LogRecord{
+			Level:   INFO,
+			Source:  "github.com/example/app.handler:42",
+			Message: "héllo world",
+			Created: now,
+		},
+		Formats: map[string]string{
+			"[%-5V][%5V][%5L]":  "[INFO ][ INFO][ INFO]\n",
+			"[%.10S]":           "[handler:42]\n",
+			"[%12.5M]|[%-7.5M]": "[       héllo]|[héllo  ]\n",
+			"[%.0M][%3.2L]":     "[][ IN]\n",
+		},
+	},
+}
+
+func hostname() string {
+	host, _ := os.Hostname()
+	return host
 }
 
 func TestFormatLogRecord(t *testing.T) {
@@ -74,10 +150,103 @@ func TestFormatLogRecord(t *testing.T) {
 				t.Errorf("   got %q", got)
 				t.Errorf("  want %q", want)
 			}
+			if got := string(CompileFormat(fmt).Format([]byte("x"), test.Record)); got != "x"+want {
+				t.Errorf("%s - %s (compiled):", name, fmt)
+				t.Errorf("   got %q", got)
+				t.Errorf("  want %q", "x"+want)
+			}
+		}
+	}
+}
+
+func TestFormatLogRecordCacheBound(t *testing.T) {
+	rec := newLogRecord(INFO, "src", "message")
+	for i := 0; i < 2*maxCompiledFormats; i++ {
+		format := fmt.Sprintf("%%M %d", i)
+		if got, want := FormatLogRecord(format, rec), fmt.Sprintf("message %d\n", i); got != want {
+			t.Fatalf("FormatLogRecord(%q) = %q, want %q", format, got, want)
+		}
+	}
+	cached := 0
+	compiledFormats.Range(func(key, value interface{}) bool {
+		cached++
+		return true
+	})
+	if cached > maxCompiledFormats {
+		t.Errorf("%d formats cached, want at most %d", cached, maxCompiledFormats)
+	}
+}
+
+func TestFormatters(t *testing.T) {
+	rec := &LogRecord{
+		Level:   ERROR,
+		Source:  "log4go_test",
+		Message: "two words",
+		Created: now,
+		Fields:  Fields{{"user", "kevlar"}},
+	}
+	tests := []struct {
+		Name      string
+		Formatter Formatter
+		Want      string
+	}{
+		{"pattern", PatternFormatter("[%L] %M"), "[EROR] two words\n"},
+		{"json", JSONFormatter{}, `{"ts":"2009-02-13T23:31:30Z","level":"ERROR","level_num":3,"func":"log4go_test","msg":"two words","fields":{"user":"kevlar"}}` + "\n"},
+		{"json keys", JSONFormatter{TimeKey: "@timestamp", MessageKey: "message"}, `{"@timestamp":"2009-02-13T23:31:30Z","level":"ERROR","level_num":3,"func":"log4go_test","message":"two words","fields":{"user":"kevlar"}}` + "\n"},
+		{"logfmt", LogfmtFormatter{}, `ts=2009-02-13T23:31:30Z level=error src=log4go_test msg="two words" user=kevlar` + "\n"},
+		{"console", consoleFormatter{}, "EROR Fri, 13 Feb 2009 23:31:30 UTC : two words user=kevlar\n"},
+	}
+	for _, test := range tests {
+		if got := string(test.Formatter.Format(nil, rec)); got != test.Want {
+			t.Errorf("%s:  got %q", test.Name, got)
+			t.Errorf("%s: want %q", test.Name, test.Want)
 		}
 	}
 }
 
+func TestJSONFormatterSource(t *testing.T) {
+	rec := &LogRecord{
+		Level:   INFO,
+		Source:  "main.main:12",
+		File:    "/src/main.go",
+		Line:    12,
+		Prefix:  "web",
+		Message: "tab\tquote\" \u2028",
+		Created: now.Add(123),
+		Fields:  Fields{{"err", errors.New("failed")}, {"n", 1.5}},
+	}
+	want := `{"ts":"2009-02-13T23:31:30.000000123Z","level":"INFO","level_num":6,"func":"main.main","file":"/src/main.go","line":12,"prefix":"web","msg":"tab\tquote\" \u2028","fields":{"err":"failed","n":1.5}}` + "\n"
+	got := string(JSONFormatter{}.Format(nil, rec))
+	if got != want {
+		t.Errorf(" got %s", got)
+		t.Errorf("want %s", want)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(got), &decoded); err != nil {
+		t.Errorf("output is not valid JSON: %s", err)
+	}
+}
+
+func TestLogfmtFormatterQuoting(t *testing.T) {
+	rec := &LogRecord{
+		Level:   WARNING,
+		Message: "say \"hi\"\there",
+		Created: now,
+		Fields: Fields{
+			{"empty", ""},
+			{"eq", "a=b"},
+			{"bad key", "back\\slash"},
+			{"err", errors.New("no such file")},
+			{"n", 42},
+		},
+	}
+	want := `ts=2009-02-13T23:31:30Z level=warning msg="say \"hi\"\there" empty="" eq="a=b" bad_key="back\\slash" err="no such file" n=42` + "\n"
+	if got := string(LogfmtFormatter{}.Format(nil, rec)); got != want {
+		t.Errorf(" got %s", got)
+		t.Errorf("want %s", want)
+	}
+}
+
 var logRecordWriteTests = []struct {
 	Test    string
 	Record  *LogRecord
@@ -96,10 +265,8 @@ var logRecordWriteTests = []struct {
 }
 
 func TestConsoleLogWriter(t *testing.T) {
-	console := make(ConsoleLogWriter)
-
 	r, w := io.Pipe()
-	go console.run(w)
+	console := newConsoleLogWriter(w, w)
 	defer console.Close()
 
 	buf := make([]byte, 1024)
@@ -117,6 +284,127 @@ func TestConsoleLogWriter(t *testing.T) {
 	}
 }
 
+// streamWriter records which stream each write went to, in order.
+type streamWriter struct {
+	name  string
+	lines *[]string
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	*w.lines = append(*w.lines, w.name+": "+string(p))
+	return len(p), nil
+}
+
+func TestConsoleLogWriterSplit(t *testing.T) {
+	var lines []string
+	w := newConsoleLogWriter(streamWriter{"stdout", &lines}, streamWriter{"stderr", &lines})
+	w.SetStderrLevel(WARNING).SetFormatter(CompileFormat("[%L] %M"))
+	for _, lvl := range []LogLevel{INFO, WARNING, DEBUG, CRITICAL, NOTICE} {
+		w.LogWrite(&LogRecord{Level: lvl, Message: "message", Created: now})
+	}
+	w.Close()
+
+	want := []string{
+		"stdout: [INFO] message\n",
+		"stderr: [WARN] message\n",
+		"stdout: [DEBG] message\n",
+		"stderr: [CRIT] message\n",
+		"stdout: [NOTC] message\n",
+	}
+	if strings.Join(lines, "") != strings.Join(want, "") {
+		t.Errorf("split output:\n got %q\nwant %q", lines, want)
+	}
+
+	// From XML, using the package's standard output and error
+	defer func(out, err io.Writer) {
+		stdout, stderr = out, err
+	}(stdout, stderr)
+	lines = nil
+	stdout, stderr = streamWriter{"stdout", &lines}, streamWriter{"stderr", &lines}
+
+	const config = "_logtest.xml"
+	err := ioutil.WriteFile(config, []byte(`<logging>
+  <filter enabled="true">
+    <tag>stdout</tag>
+    <type>console</type>
+    <level>DEBUG</level>
+    <property name="format">%L %M</property>
+    <property name="stderrlevel">ERROR</property>
+  </filter>
+</logging>`), 0644)
+	if err != nil {
+		t.Fatalf("write(%q): %s", config, err)
+	}
+	defer os.Remove(config)
+
+	l := NewLogger()
+	l.LoadConfiguration(config)
+	l.Log(WARNING, "src", "warning")
+	l.Log(ERROR, "src", "error")
+	l.Close()
+
+	want = []string{"stdout: WARN warning\n", "stderr: EROR error\n"}
+	if strings.Join(lines, "") != strings.Join(want, "") {
+		t.Errorf("split output from XML:\n got %q\nwant %q", lines, want)
+	}
+}
+
+func TestConsoleLogWriterColor(t *testing.T) {
+	rec := &LogRecord{Level: ERROR, Message: "failed", Created: now}
+	debug := &LogRecord{Level: DEBUG, Message: "details", Created: now}
+	info := &LogRecord{Level: INFO, Message: "started", Created: now}
+
+	palette := DefaultPalette
+	palette[INFO] = "\x1b[32m"
+
+	tests := []struct {
+		Test   string
+		Writer func(out io.Writer) *ConsoleLogWriter
+		Want   string
+	}{
+		{"auto (not a terminal)", func(out io.Writer) *ConsoleLogWriter {
+			return newConsoleLogWriter(out, out).SetFormatter(CompileFormat("[%L] %M"))
+		}, "[EROR] failed\n[DEBG] details\n[INFO] started\n"},
+		{"always", func(out io.Writer) *ConsoleLogWriter {
+			return newConsoleLogWriter(out, out).SetColor(ColorAlways).SetFormatter(CompileFormat("[%L] %M"))
+		}, "\x1b[31m[EROR] failed\x1b[0m\n\x1b[2m[DEBG] details\x1b[0m\n[INFO] started\n"},
+		{"palette", func(out io.Writer) *ConsoleLogWriter {
+			return newConsoleLogWriter(out, out).SetColor(ColorAlways).SetPalette(palette).SetFormatter(CompileFormat("[%L] %M"))
+		}, "\x1b[31m[EROR] failed\x1b[0m\n\x1b[2m[DEBG] details\x1b[0m\n\x1b[32m[INFO] started\x1b[0m\n"},
+		{"color verb", func(out io.Writer) *ConsoleLogWriter {
+			return newConsoleLogWriter(out, out).SetColor(ColorAlways).SetFormatter(CompileFormat("[%C%L%c] %M"))
+		}, "[\x1b[31mEROR\x1b[0m] failed\n[\x1b[2mDEBG\x1b[0m] details\n[INFO] started\n"},
+		{"color verb (never)", func(out io.Writer) *ConsoleLogWriter {
+			return newConsoleLogWriter(out, out).SetColor(ColorNever).SetFormatter(CompileFormat("[%C%L%c] %M"))
+		}, "[EROR] failed\n[DEBG] details\n[INFO] started\n"},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		w := test.Writer(buf)
+		w.LogWrite(rec)
+		w.LogWrite(debug)
+		w.LogWrite(info)
+		w.Close()
+		if got := buf.String(); got != test.Want {
+			t.Errorf("%s: got %q, want %q", test.Test, got, test.Want)
+		}
+	}
+
+	// An unterminated %C is reset at the end of the line
+	if got, want := string(formatColor(CompileFormat("%C%M"), nil, rec, &DefaultPalette)), "\x1b[31mfailed\x1b[0m\n"; got != want {
+		t.Errorf("unterminated %%C: got %q, want %q", got, want)
+	}
+
+	t.Setenv("NO_COLOR", "1")
+	if ColorAuto.enabled(os.Stdout) {
+		t.Errorf("ColorAuto is enabled with NO_COLOR set")
+	}
+	if !ColorAlways.enabled(os.Stdout) {
+		t.Errorf("ColorAlways is not enabled with NO_COLOR set")
+	}
+}
+
 func TestFileLogWriter(t *testing.T) {
 	defer func(buflen int) {
 		LogBufferLength = buflen
@@ -140,13 +428,927 @@ func TestFileLogWriter(t *testing.T) {
 	}
 }
 
+// readGzip returns the decompressed contents of a gzip file.
+func readGzip(t *testing.T, name string) string {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("open(%q): %s", name, err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip(%q): %s", name, err)
+	}
+	contents, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("read(%q): %s", name, err)
+	}
+	return string(contents)
+}
+
+func TestFileLogWriterCompress(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.log")
+
+	// Leftovers from a process which died: a rotated file which was never
+	// compressed, a partial compression, and one which was compressed but not
+	// removed
+	for file, contents := range map[string]string{
+		name:                  "current\n",
+		name + ".001":         "first\n",
+		name + ".002.gz.tmp":  "partial",
+		name + ".002":         "second\n",
+		name + ".003":         "third\n",
+		name + ".003.gz":      "",
+		name + ".notabackup": "other\n",
+	} {
+		if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatalf("write(%q): %s", file, err)
+		}
+	}
+	// The current file is appended to until it is rotated
+	w := NewFileLogWriter(name, true).SetFormat("%M").SetCompress(CompressGzip)
+	w.LogWrite(&LogRecord{Level: INFO, Message: "before", Created: now})
+	w.Rotate()
+	w.LogWrite(&LogRecord{Level: INFO, Message: "after", Created: now})
+	w.Close()
+
+	for _, file := range []string{name + ".001", name + ".002", name + ".002.gz.tmp", name + ".003", name + ".004", name + ".005"} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("%s exists (err = %v)", filepath.Base(file), err)
+		}
+	}
+	for file, want := range map[string]string{
+		name + ".001.gz": "first\n",
+		name + ".002.gz": "second\n",
+		name + ".004.gz": "current\nbefore\n",
+	} {
+		if got := readGzip(t, file); got != want {
+			t.Errorf("%s: got %q, want %q", filepath.Base(file), got, want)
+		}
+	}
+	if contents, _ := ioutil.ReadFile(name); string(contents) != "after\n" {
+		t.Errorf("%s: got %q, want %q", filepath.Base(name), contents, "after\n")
+	}
+	if _, err := os.Stat(name + ".notabackup"); err != nil {
+		t.Errorf("unrelated file was removed: %s", err)
+	}
+}
+
+// writeBackups creates rotated files of size bytes each, the first one hour
+// old, the next two hours old and so on.
+func writeBackups(t *testing.T, name string, size int, exts ...string) {
+	for i, ext := range exts {
+		file := name + ext
+		if err := ioutil.WriteFile(file, bytes.Repeat([]byte("x"), size), 0644); err != nil {
+			t.Fatalf("write(%q): %s", file, err)
+		}
+		mtime := time.Now().Add(-time.Duration(i+1) * time.Hour)
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatalf("chtimes(%q): %s", file, err)
+		}
+	}
+}
+
+// listBackups returns the extensions of the files rotated out from name.
+func listBackups(name string) []string {
+	matches, _ := filepath.Glob(name + ".*")
+	for i := range matches {
+		matches[i] = strings.TrimPrefix(matches[i], name)
+	}
+	return matches
+}
+
+func TestFileLogWriterRetention(t *testing.T) {
+	tests := []struct {
+		Test   string
+		Setup  func(w *FileLogWriter) *FileLogWriter
+		Remain string
+	}{
+		{"count", func(w *FileLogWriter) *FileLogWriter {
+			return w.SetMaxBackups(3)
+		}, ".001 .002 .004"},
+		{"age", func(w *FileLogWriter) *FileLogWriter {
+			return w.SetMaxAge(150 * time.Minute)
+		}, ".001 .002 .004"},
+		{"total size", func(w *FileLogWriter) *FileLogWriter {
+			return w.SetMaxTotalSize(200)
+		}, ".001 .004"},
+		{"compressed", func(w *FileLogWriter) *FileLogWriter {
+			return w.SetCompress(CompressGzip).SetMaxBackups(2)
+		}, ".001.gz .004.gz"},
+	}
+	for _, test := range tests {
+		name := filepath.Join(t.TempDir(), "test.log")
+		writeBackups(t, name, 100, ".001", ".002", ".003.gz")
+		w := test.Setup(NewFileLogWriter(name, true).SetFormat("%M"))
+		w.LogWrite(&LogRecord{Level: INFO, Message: "message", Created: now})
+		w.Rotate()
+		w.Close()
+
+		if got := strings.Join(listBackups(name), " "); got != test.Remain {
+			t.Errorf("%s: got backups %q, want %q", test.Test, got, test.Remain)
+		}
+	}
+
+	// With all of the numbers used, the oldest makes way for the next
+	name := filepath.Join(t.TempDir(), "test.log")
+	exts := make([]string, 999)
+	for i := range exts {
+		exts[i] = fmt.Sprintf(".%03d", 999-i)
+	}
+	writeBackups(t, name, 1, exts...)
+	w := NewFileLogWriter(name, true).SetMaxAge(10000 * time.Hour)
+	w.Rotate()
+	w.Close()
+	if _, err := os.Stat(name); err != nil {
+		t.Errorf("rotation with no free numbers failed: %s", err)
+	}
+	if n := len(listBackups(name)); n != 999 {
+		t.Errorf("got %d backups, want 999", n)
+	}
+}
+
+func TestFilenamePattern(t *testing.T) {
+	at := time.Date(2009, 2, 13, 23, 31, 30, 0, time.Local)
+	tests := []struct {
+		Pattern, Name, Glob string
+		Next                time.Time
+	}{
+		{"app-%Y%m%d-%H.log", "app-20090213-23.log", "app-*-*.log", time.Date(2009, 2, 14, 0, 0, 0, 0, time.Local)},
+		{"logs/%Y/%m/app.log", "logs/2009/02/app.log", "logs/*/*/app.log", time.Date(2009, 3, 1, 0, 0, 0, 0, time.Local)},
+		{"app.%Y-%m-%dT%H%M%S", "app.2009-02-13T233130", "app.*-*-*T*", time.Date(2009, 2, 13, 23, 31, 31, 0, time.Local)},
+		{"100%%-%Y.log%q", "100%-2009.log%q", "100%-*.log%q", time.Date(2010, 1, 1, 0, 0, 0, 0, time.Local)},
+		{"app.log", "app.log", "app.log", time.Time{}},
+	}
+	for _, test := range tests {
+		if got := expandFilename(test.Pattern, at); got != test.Name {
+			t.Errorf("expandFilename(%q) = %q, want %q", test.Pattern, got, test.Name)
+		}
+		if got := filenameGlob(test.Pattern); got != test.Glob {
+			t.Errorf("filenameGlob(%q) = %q, want %q", test.Pattern, got, test.Glob)
+		}
+		var next time.Time
+		if period := filenamePeriod(test.Pattern); period != 0 {
+			next = nextPeriod(at, period)
+		}
+		if !next.Equal(test.Next) {
+			t.Errorf("%q: next period at %s, want %s", test.Pattern, next, test.Next)
+		}
+	}
+}
+
+func TestFileLogWriterRotateSchedule(t *testing.T) {
+	w := NewFileLogWriter(filepath.Join(t.TempDir(), "test.log"), false)
+	defer w.Close()
+	opened := w.opened
+
+	if !w.rotateAt.IsZero() {
+		t.Errorf("rotation scheduled at %s without any time limit", w.rotateAt)
+	}
+	w.SetRotateDaily(true)
+	if want := nextPeriod(opened, 'd'); !w.rotateAt.Equal(want) {
+		t.Errorf("daily: rotation at %s, want %s", w.rotateAt, want)
+	}
+	w.SetRotateHourly(true)
+	if want := nextPeriod(opened, 'H'); !w.rotateAt.Equal(want) {
+		t.Errorf("hourly: rotation at %s, want %s", w.rotateAt, want)
+	}
+	w.SetRotateInterval(time.Minute)
+	if want := opened.Truncate(time.Minute).Add(time.Minute); !w.rotateAt.Equal(want) {
+		t.Errorf("interval: rotation at %s, want %s", w.rotateAt, want)
+	}
+}
+
+func TestFileLogWriterBackupNaming(t *testing.T) {
+	for _, test := range []struct {
+		Naming BackupNaming
+		Layout string
+	}{
+		{BackupDate, "2006-01-02"},
+		{BackupDateTime, "2006-01-02-150405"},
+	} {
+		name := filepath.Join(t.TempDir(), "test.log")
+		w := NewFileLogWriter(name, true).SetFormat("%M").SetBackupNaming(test.Naming)
+		opened := w.opened
+		w.LogWrite(&LogRecord{Level: INFO, Message: "first", Created: now})
+		w.Rotate()
+		w.LogWrite(&LogRecord{Level: INFO, Message: "second", Created: now})
+		w.Rotate()
+		w.Close()
+
+		// The second file may have been opened in the next second
+		ext := "." + opened.Format(test.Layout)
+		if contents, err := ioutil.ReadFile(name + ext); err != nil || string(contents) != "first\n" {
+			t.Errorf("%s: %s%s contains %q (err = %v)", test.Naming, filepath.Base(name), ext, contents, err)
+		}
+		if backups := listBackups(name); len(backups) != 2 {
+			t.Errorf("%s: got backups %q, want two", test.Naming, backups)
+		}
+	}
+
+	// Dated backups sort by age with numbered ones, and collide safely
+	name := filepath.Join(t.TempDir(), "test.log")
+	writeBackups(t, name, 1, ".2009-02-14", ".2009-02-13.1", ".2009-02-13-233130.gz", ".001", ".2009-02-13.x")
+	w := NewFileLogWriter(name, false).SetMaxBackups(3)
+	w.Close()
+	w.rotated().retain()
+	if got, want := strings.Join(listBackups(name), " "), ".2009-02-13-233130.gz .2009-02-13.1 .2009-02-13.x .2009-02-14"; got != want {
+		t.Errorf("got backups %q, want %q", got, want)
+	}
+}
+
+func TestFileLogWriterShift(t *testing.T) {
+	for _, test := range []struct {
+		Test   string
+		Setup  func(w *FileLogWriter) *FileLogWriter
+		Remain string
+		Read   func(t *testing.T, name string) string
+	}{
+		{"unlimited", func(w *FileLogWriter) *FileLogWriter {
+			return w
+		}, ".1 .2 .3 .4", func(t *testing.T, name string) string {
+			contents, _ := ioutil.ReadFile(name)
+			return string(contents)
+		}},
+		{"compressed", func(w *FileLogWriter) *FileLogWriter {
+			return w.SetCompress(CompressGzip).SetMaxBackups(2)
+		}, ".1.gz .2.gz", func(t *testing.T, name string) string {
+			return readGzip(t, name+".gz")
+		}},
+	} {
+		name := filepath.Join(t.TempDir(), "test.log")
+		w := test.Setup(NewFileLogWriter(name, true).SetFormat("%M").SetBackupNaming(BackupShift))
+		for i := 1; i <= 4; i++ {
+			w.LogWrite(&LogRecord{Level: INFO, Message: "file " + strconv.Itoa(i), Created: now})
+			w.Rotate()
+		}
+		w.Close()
+
+		if got := strings.Join(listBackups(name), " "); got != test.Remain {
+			t.Errorf("%s: got backups %q, want %q", test.Test, got, test.Remain)
+		}
+		for n, want := range []string{"file 4\n", "file 3\n"} {
+			if got := test.Read(t, name+"."+strconv.Itoa(n+1)); got != want {
+				t.Errorf("%s: .%d contains %q, want %q", test.Test, n+1, got, want)
+			}
+		}
+	}
+}
+
+func TestFileLogWriterReopen(t *testing.T) {
+	// readFile returns the contents of name, or the error
+	readFile := func(name string) string {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err.Error()
+		}
+		return string(contents)
+	}
+	write := func(w *FileLogWriter, msg string) {
+		w.LogWrite(&LogRecord{Level: INFO, Message: msg, Created: now})
+	}
+
+	// Explicitly, after the file has been moved
+	name := filepath.Join(t.TempDir(), "test.log")
+	w := NewFileLogWriter(name, false).SetFormat("%M")
+	write(w, "before")
+	w.Flush(context.Background())
+	os.Rename(name, name+".moved")
+	w.Reopen()
+	write(w, "after")
+	w.Close()
+	if got, want := readFile(name+".moved")+readFile(name), "before\nafter\n"; got != want {
+		t.Errorf("Reopen: got %q, want %q", got, want)
+	}
+
+	// Automatically, after the file has been deleted
+	name = filepath.Join(t.TempDir(), "test.log")
+	w = NewFileLogWriter(name, false).SetFormat("%M").SetReopenOnMove(time.Nanosecond)
+	write(w, "before")
+	w.Flush(context.Background())
+	os.Remove(name)
+	write(w, "after")
+	w.Close()
+	if got, want := readFile(name), "after\n"; got != want {
+		t.Errorf("SetReopenOnMove: got %q, want %q", got, want)
+	}
+
+	// On a signal
+	if len(reopenSignals) == 0 {
+		t.Skip("no signal to reopen on")
+	}
+	name = filepath.Join(t.TempDir(), "test.log")
+	w = NewFileLogWriter(name, false).SetFormat("%M").ReopenOnSignal()
+	write(w, "before")
+	w.Flush(context.Background())
+	os.Rename(name, name+".moved")
+	self, _ := os.FindProcess(os.Getpid())
+	if err := self.Signal(reopenSignals[0]); err != nil {
+		t.Fatalf("signal: %s", err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(name); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	write(w, "after")
+	w.Close()
+	if got, want := readFile(name+".moved")+readFile(name), "before\nafter\n"; got != want {
+		t.Errorf("ReopenOnSignal: got %q, want %q", got, want)
+	}
+}
+
+func TestFileLogWriterBuffer(t *testing.T) {
+	readFile := func(name string) string {
+		contents, _ := ioutil.ReadFile(name)
+		return string(contents)
+	}
+	// written waits until the writer has handled the records sent so far
+	written := func(w *FileLogWriter) {
+		done := make(chan bool)
+		w.control(context.Background(), func() error {
+			close(done)
+			return nil
+		})
+		<-done
+	}
+
+	// Buffered records are written out by an ERROR with SyncLevel
+	name := filepath.Join(t.TempDir(), "test.log")
+	w := NewFileLogWriter(name, false).SetFormat("%M").SetBuffer(4096, time.Hour).SetSyncPolicy(SyncLevel)
+	w.LogWrite(newLogRecord(INFO, "src", "info"))
+	written(w)
+	if got := readFile(name); got != "" {
+		t.Errorf("buffered: file has %q, want nothing yet", got)
+	}
+	w.LogWrite(newLogRecord(ERROR, "src", "error"))
+	written(w)
+	if got, want := readFile(name), "info\nerror\n"; got != want {
+		t.Errorf("after an ERROR: file has %q, want %q", got, want)
+	}
+	w.Close()
+
+	// When the buffer is full
+	name = filepath.Join(t.TempDir(), "test.log")
+	w = NewFileLogWriter(name, false).SetFormat("%M").SetBuffer(16, time.Hour)
+	for i := 0; i < 3; i++ {
+		w.LogWrite(newLogRecord(INFO, "src", "123456789"))
+	}
+	written(w)
+	if got := len(readFile(name)); got == 0 || got >= 30 {
+		t.Errorf("full buffer: file has %d bytes, want some but not all of 30", got)
+	}
+	w.Close()
+	if got := len(readFile(name)); got != 30 {
+		t.Errorf("after Close: file has %d bytes, want 30", got)
+	}
+
+	// After the flush interval
+	name = filepath.Join(t.TempDir(), "test.log")
+	w = NewFileLogWriter(name, false).SetFormat("%M").SetBuffer(4096, time.Millisecond).SetSyncPolicy(SyncInterval).SetSyncInterval(time.Millisecond)
+	w.LogWrite(newLogRecord(INFO, "src", "later"))
+	for i := 0; i < 100 && readFile(name) == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, want := readFile(name), "later\n"; got != want {
+		t.Errorf("after the interval: file has %q, want %q", got, want)
+	}
+	w.Close()
+
+	// Buffered records which cannot be written are kept, and go to standard
+	// error when the file is closed
+	defer func(err io.Writer) {
+		stderr = err
+	}(stderr)
+	var lines []string
+	stderr = streamWriter{"stderr", &lines}
+	name = filepath.Join(t.TempDir(), "test.log")
+	w = NewFileLogWriter(name, false).SetFormat("%M").SetBuffer(4096, time.Hour).SetSyncPolicy(SyncLevel)
+	w.LogWrite(newLogRecord(INFO, "src", "buffered"))
+	w.control(context.Background(), func() error {
+		w.file.Close()
+		w.file, _ = os.Open(name)
+		return nil
+	})
+	w.LogWrite(newLogRecord(ERROR, "src", "unwritable"))
+	w.Close()
+	got := strings.Join(lines, "")
+	if !strings.Contains(got, "buffered") || !strings.Contains(got, "unwritable") {
+		t.Errorf("stderr %q, want both records", got)
+	}
+	if strings.Count(got, "buffered") != 1 {
+		t.Errorf("stderr %q, want the buffered record once", got)
+	}
+
+	// A record whose sync fails is not written again when retried, and a
+	// record reused after that is still written.  A pipe cannot be synced.
+	r, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %s", err)
+	}
+	defer r.Close()
+	lines = nil
+	name = filepath.Join(t.TempDir(), "test.log")
+	w = NewFileLogWriter(name, false).SetFormat("%M").SetSyncPolicy(SyncEachRecord).SetRetryPolicy(RetryPolicy{Attempts: 1, Backoff: time.Millisecond})
+	w.control(context.Background(), func() error {
+		w.file.Close()
+		w.file = pw
+		return nil
+	})
+	rec := newLogRecord(INFO, "src", "reused")
+	w.LogWrite(rec)
+	w.Flush(context.Background())
+	time.Sleep(5 * time.Millisecond)
+	w.LogWrite(rec)
+	w.Close()
+	contents, _ := ioutil.ReadAll(r)
+	if got, want := string(contents), "reused\nreused\n"; got != want {
+		t.Errorf("pipe has %q, want %q", got, want)
+	}
+}
+
+func TestFileLogWriterSymlink(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "app.log")
+	w := NewPatternFileLogWriter(filepath.Join(dir, "app-%Y%m%d%H%M%S.log"), false).SetFormat("%M").SetSymlink(link)
+	w.LogWrite(newLogRecord(INFO, "src", "first"))
+	w.Rotate()
+	w.LogWrite(newLogRecord(INFO, "src", "second"))
+	w.Close()
+
+	target, err := os.Readlink(link)
+	if err != nil {
+		t.Fatalf("Readlink: %s", err)
+	}
+	if want := filepath.Base(w.filename); target != want {
+		t.Errorf("symlink points at %q, want %q", target, want)
+	}
+	if contents, _ := ioutil.ReadFile(link); !strings.HasSuffix(string(contents), "second\n") {
+		t.Errorf("through the symlink: %q, want the current file", contents)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.link")); len(matches) != 0 {
+		t.Errorf("temporary links left behind: %q", matches)
+	}
+
+	// A regular file is not replaced
+	dir = t.TempDir()
+	link = filepath.Join(dir, "app.log")
+	ioutil.WriteFile(link, []byte("keep"), 0660)
+	NewFileLogWriter(filepath.Join(dir, "other.log"), false).SetSymlink(link).Close()
+	if contents, _ := ioutil.ReadFile(link); string(contents) != "keep" {
+		t.Errorf("regular file at the symlink's name replaced by %q", contents)
+	}
+
+	// A relative file name with an absolute symlink, and the other way round
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	dir = t.TempDir()
+	os.Mkdir(filepath.Join(dir, "logs"), 0770)
+	os.Mkdir(filepath.Join(dir, "links"), 0770)
+	os.Chdir(dir)
+	for _, test := range []struct {
+		filename, link string
+	}{
+		{"logs/rel.log", filepath.Join(dir, "links", "abs.log")},
+		{filepath.Join(dir, "logs", "abs.log"), "links/rel.log"},
+	} {
+		w = NewFileLogWriter(test.filename, false).SetFormat("%M").SetSymlink(test.link)
+		w.LogWrite(newLogRecord(INFO, "src", test.filename))
+		w.Close()
+		if contents, _ := ioutil.ReadFile(test.link); string(contents) != test.filename+"\n" {
+			t.Errorf("%s through %s: %q, want the file", test.filename, test.link, contents)
+		}
+	}
+}
+
+func TestFileLogWriterResume(t *testing.T) {
+	// existing writes a file as a previous run would have left it
+	existing := func(name string, lines int, modTime time.Time) {
+		ioutil.WriteFile(name, []byte(strings.Repeat("previous run\n", lines)), 0660)
+		os.Chtimes(name, modTime, modTime)
+	}
+	write := func(w *FileLogWriter, n int) {
+		for i := 0; i < n; i++ {
+			w.LogWrite(newLogRecord(INFO, "src", "this run"))
+		}
+		w.Close()
+	}
+	rotated := func(name string) bool {
+		_, err := os.Stat(name + ".001")
+		return err == nil
+	}
+	recent := time.Now().Add(-time.Minute)
+
+	// The size carries on from the existing file
+	name := filepath.Join(t.TempDir(), "test.log")
+	existing(name, 7, recent) // 91 bytes
+	write(NewFileLogWriter(name, true).SetFormat("%M").SetRotateSize(100), 2)
+	if !rotated(name) {
+		t.Errorf("size: existing file not counted towards the limit")
+	}
+
+	// So do the lines, if counted
+	name = filepath.Join(t.TempDir(), "test.log")
+	existing(name, 5, recent)
+	write(NewFileLogWriter(name, true).SetFormat("%M").SetCountExistingLines(true).SetRotateLines(6), 2)
+	if !rotated(name) {
+		t.Errorf("lines: existing lines not counted towards the limit")
+	}
+	name = filepath.Join(t.TempDir(), "test.log")
+	existing(name, 5, recent)
+	write(NewFileLogWriter(name, true).SetFormat("%M").SetRotateLines(6), 2)
+	if rotated(name) {
+		t.Errorf("lines: existing lines counted without SetCountExistingLines")
+	}
+
+	// From XML
+	name = filepath.Join(t.TempDir(), "test.log")
+	existing(name, 5, recent)
+	config := filepath.Join(t.TempDir(), "config.xml")
+	ioutil.WriteFile(config, []byte(`<logging>
+  <filter enabled="true">
+    <tag>file</tag>
+    <type>file</type>
+    <level>DEBUG</level>
+    <property name="filename">`+name+`</property>
+    <property name="format">%M</property>
+    <property name="rotate">true</property>
+    <property name="maxlines">6</property>
+    <property name="countlines">true</property>
+  </filter>
+</logging>`), 0644)
+	l := NewLogger()
+	l.LoadConfiguration(config)
+	l.Info("this run")
+	l.Info("this run")
+	l.Close()
+	if !rotated(name) {
+		t.Errorf("XML countlines: existing lines not counted towards the limit")
+	}
+
+	// A file from yesterday is rotated by the first record, and named for
+	// the day it was written
+	name = filepath.Join(t.TempDir(), "test.log")
+	yesterday := time.Now().AddDate(0, 0, -1)
+	existing(name, 1, yesterday)
+	write(NewFileLogWriter(name, true).SetFormat("%M").SetBackupNaming(BackupDate).SetRotateDaily(true), 1)
+	backup := name + "." + yesterday.Format(backupDateLayout)
+	if contents, err := ioutil.ReadFile(backup); err != nil || string(contents) != "previous run\n" {
+		t.Errorf("daily: %s has %q (%v), want yesterday's file", backup, contents, err)
+	}
+	if contents, _ := ioutil.ReadFile(name); string(contents) != "this run\n" {
+		t.Errorf("daily: current file has %q, want only this run", contents)
+	}
+}
+
+func TestFileLogWriterMultiProcess(t *testing.T) {
+	// Writers stand in for processes; flock locks conflict between open files
+	// even within one process
+	name := filepath.Join(t.TempDir(), "test.log")
+	ioutil.WriteFile(name, []byte("previous run\n"), 0660)
+	var writers [2]*FileLogWriter
+	for i := range writers {
+		writers[i] = NewFileLogWriter(name, true).SetMultiProcess(true).SetRotateSize(100).SetFormat("%M")
+	}
+
+	// Taking turns, each file stops growing once it is full
+	for i := 0; i < 20; i++ {
+		w := writers[i%2]
+		w.LogWrite(newLogRecord(INFO, "src", fmt.Sprintf("writer %d line %02d", i%2, i)))
+		w.Flush(context.Background())
+	}
+	// checkFiles checks that the files hold lines lines, and none has more
+	// than max bytes
+	checkFiles := func(test string, lines, max int) {
+		files, _ := filepath.Glob(name + "*")
+		got := 0
+		for _, file := range files {
+			if strings.HasSuffix(file, ".lock") {
+				continue
+			}
+			contents, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatalf("read(%q): %s", file, err)
+			}
+			if len(contents) > max {
+				t.Errorf("%s: %s has %d bytes, want the size limit to hold across writers", test, file, len(contents))
+			}
+			got += strings.Count(string(contents), "\n")
+		}
+		if got != lines {
+			t.Errorf("%s: %d lines in %d files, want %d", test, got, len(files), lines)
+		}
+	}
+	checkFiles("in turn", 21, 100+18)
+
+	// At the same time, rotations do not overwrite each other's files
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func(w *FileLogWriter, i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				w.LogWrite(newLogRecord(INFO, "src", fmt.Sprintf("writer %d line %03d", i, j)))
+			}
+			w.Close()
+		}(writers[i], i)
+	}
+	wg.Wait()
+	checkFiles("concurrently", 421, 200)
+	if _, err := os.Stat(name + ".lock"); err != nil {
+		t.Errorf("no lock file: %s", err)
+	}
+
+	// Another process's compression is left alone, unless it was abandoned
+	name = filepath.Join(t.TempDir(), "test.log")
+	stale := time.Now().Add(-time.Hour)
+	for _, ext := range []string{".001", ".001.gz.tmp", ".002", ".002.gz.tmp"} {
+		ioutil.WriteFile(name+ext, []byte("rotated\n"), 0660)
+		if strings.HasPrefix(ext, ".002") {
+			os.Chtimes(name+ext, stale, stale)
+		}
+	}
+	w := NewFileLogWriter(name, true).SetCompress(CompressGzip).SetMultiProcess(true)
+	w.LogWrite(newLogRecord(INFO, "src", "recovering"))
+	w.Close()
+	if got, want := strings.Join(listBackups(name), " "), ".001 .001.gz.tmp .002.gz"; got != want {
+		t.Errorf("after recovering compression: got %q, want %q", got, want)
+	}
+}
+
+func TestPatternFileLogWriterMaintenance(t *testing.T) {
+	// Rotating while earlier rotations are still being compressed and
+	// removed in the background
+	dir := t.TempDir()
+	w := NewPatternFileLogWriter(filepath.Join(dir, "app-%Y.log"), true).SetFormat("%M").SetCompress(CompressGzip).SetMaxBackups(3)
+	for i := 0; i < 10; i++ {
+		w.LogWrite(newLogRecord(INFO, "src", fmt.Sprintf("record %d", i)))
+		w.Rotate()
+	}
+	w.Close()
+
+	name := expandFilename(filepath.Join(dir, "app-%Y.log"), time.Now())
+	backups := listBackups(name)
+	if len(backups) != 3 {
+		t.Errorf("got backups %q, want 3", backups)
+	}
+	for _, ext := range backups {
+		if !strings.HasSuffix(ext, ".gz") {
+			t.Errorf("backup %s not compressed", ext)
+		}
+	}
+}
+
+func TestPatternFileLogWriter(t *testing.T) {
+	dir := t.TempDir()
+	pattern := filepath.Join(dir, "app-%Y%m%d.log")
+	writeBackups(t, filepath.Join(dir, "app-20090213.log"), 10, "", ".001", ".002")
+
+	w := NewPatternFileLogWriter(pattern, false).SetFormat("%M").SetCompress(CompressGzip).SetMaxBackups(2)
+	w.LogWrite(&LogRecord{Level: INFO, Message: "today", Created: now})
+	w.Close()
+	w.rotated().retain()
+
+	current := expandFilename(pattern, time.Now())
+	if contents, err := ioutil.ReadFile(current); err != nil || string(contents) != "today\n" {
+		t.Errorf("%s contains %q (err = %v)", filepath.Base(current), contents, err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"))
+	for i := range matches {
+		matches[i] = filepath.Base(matches[i])
+	}
+	if got, want := strings.Join(matches, " "), "app-20090213.log.001.gz app-20090213.log.gz "+filepath.Base(current); got != want {
+		t.Errorf("got files %q, want %q", got, want)
+	}
+}
+
+// gateWriter blocks every Write until the gate is opened, and reports when the
+// first Write arrives.
+type gateWriter struct {
+	buf     bytes.Buffer
+	started chan bool
+	gate    chan bool
+}
+
+func (w *gateWriter) Write(p []byte) (int, error) {
+	select {
+	case w.started <- true:
+	default:
+	}
+	<-w.gate
+	return w.buf.Write(p)
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	LogBufferLength = 2
+
+	tests := []struct {
+		policy OverflowPolicy
+		want   string
+		stats  OverflowStats
+		spill  string
+	}{
+		{OverflowDropNewest, "0 1 2 ", OverflowStats{Dropped: 3}, ""},
+		{OverflowDropOldest, "0 4 5 ", OverflowStats{Dropped: 3}, ""},
+		{OverflowSpill, "0 1 2 ", OverflowStats{Spilled: 3}, "3\n4\n5\n"},
+	}
+	for _, test := range tests {
+		out := &gateWriter{started: make(chan bool, 1), gate: make(chan bool)}
+		spill := new(recordingLogWriter)
+		w := NewFormatLogWriter(out, "%M").SetOverflowPolicy(test.policy, spill)
+
+		w.LogWrite(newLogRecord(INFO, "src", "0 "))
+		<-out.started
+		for i := 1; i < 6; i++ {
+			w.LogWrite(newLogRecord(INFO, "src", fmt.Sprintf("%d ", i)))
+		}
+		if got := w.OverflowStats(); got != test.stats {
+			t.Errorf("%s: stats %+v, want %+v", test.policy, got, test.stats)
+		}
+		close(out.gate)
+		w.Close()
+
+		got := strings.Replace(out.buf.String(), "\n", "", -1)
+		if !strings.HasPrefix(got, test.want) || !strings.Contains(got, "log buffer overflowed") {
+			t.Errorf("%s: got %q, want %q followed by an overflow report", test.policy, got, test.want)
+		}
+		spilled := ""
+		for _, rec := range spill.recs {
+			spilled += strings.TrimSpace(rec.Message) + "\n"
+		}
+		if spilled != test.spill {
+			t.Errorf("%s: spilled %q, want %q", test.policy, spilled, test.spill)
+		}
+	}
+}
+
+func TestLoggerFlush(t *testing.T) {
+	l := NewLogger()
+	l.AddFilter("file", DEBUG, NewFileLogWriter(testLogFile, false).SetFormat("%M"))
+	l.AddFilter("rec", DEBUG, new(recordingLogWriter)) // not a Flusher
+	defer os.Remove(testLogFile)
+
+	for i := 0; i < 100; i++ {
+		l.Info("message %d", i)
+	}
+	if err := l.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	contents, err := ioutil.ReadFile(testLogFile)
+	if err != nil {
+		t.Fatalf("read(%q): %s", testLogFile, err)
+	}
+	if got := strings.Count(string(contents), "\n"); got != 100 {
+		t.Errorf("after Flush the file has %d lines, want 100", got)
+	}
+	if err := l.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown: %s", err)
+	}
+	if n := len(l.Filters()); n != 0 {
+		t.Errorf("Shutdown left %d filters", n)
+	}
+}
+
+func TestLoggerShutdownDeadline(t *testing.T) {
+	out := &gateWriter{started: make(chan bool, 1), gate: make(chan bool)}
+	defer close(out.gate)
+
+	l := NewLogger()
+	l.AddFilter("stuck", DEBUG, NewFormatLogWriter(out, "%M"))
+	l.Info("stuck")
+	<-out.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown of a stuck writer returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// failingWriter fails the first fail writes, and records the rest.
+type failingWriter struct {
+	fail int
+	buf  bytes.Buffer
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.fail > 0 {
+		w.fail--
+		return 0, errors.New("disk on fire")
+	}
+	return w.buf.Write(p)
+}
+
+func TestWriterErrors(t *testing.T) {
+	defer func(err io.Writer) {
+		stderr = err
+	}(stderr)
+	var lines []string
+	stderr = streamWriter{"stderr", &lines}
+
+	// Without retries, the failed record goes to standard error, and so do
+	// the records until the output is tried again
+	var errs []error
+	out := &failingWriter{fail: 1}
+	w := NewFormatLogWriter(out, "%M").SetErrorHandler(func(err error) {
+		errs = append(errs, err)
+	})
+	w.LogWrite(newLogRecord(ERROR, "src", "first"))
+	w.LogWrite(newLogRecord(ERROR, "src", "second"))
+	w.Close()
+	if len(errs) != 1 || errs[0].Error() != "disk on fire" {
+		t.Errorf("error handler got %v, want one error", errs)
+	}
+	if out.buf.Len() != 0 || len(lines) != 2 || !strings.Contains(lines[0], "first") || !strings.Contains(lines[1], "second") {
+		t.Errorf("degraded output %q, stderr %q, want both records on stderr", out.buf.String(), lines)
+	}
+
+	// A retry which succeeds writes the record to the output
+	lines = nil
+	out = &failingWriter{fail: 2}
+	w = NewFormatLogWriter(out, "%M").SetRetryPolicy(RetryPolicy{Attempts: 2, Backoff: time.Millisecond})
+	w.LogWrite(newLogRecord(ERROR, "src", "retried"))
+	w.Close()
+	if out.buf.String() != "retried\n" || len(lines) != 0 {
+		t.Errorf("retried output %q, stderr %q, want the record on the output", out.buf.String(), lines)
+	}
+
+	// The output is tried again after the backoff
+	lines = nil
+	out = &failingWriter{fail: 1}
+	w = NewFormatLogWriter(out, "%M").SetRetryPolicy(RetryPolicy{Backoff: time.Millisecond})
+	w.LogWrite(newLogRecord(ERROR, "src", "lost"))
+	w.Flush(context.Background())
+	time.Sleep(5 * time.Millisecond)
+	w.LogWrite(newLogRecord(ERROR, "src", "recovered"))
+	w.Close()
+	if out.buf.String() != "recovered\n" || len(lines) != 2 || !strings.Contains(lines[0], "disk on fire") {
+		t.Errorf("recovered output %q, stderr %q, want the error and the first record on stderr", out.buf.String(), lines)
+	}
+
+	// A file which cannot be opened still gives a writer
+	lines = nil
+	fw := NewFileLogWriter(filepath.Join("_no_such_dir", testLogFile), false)
+	if fw == nil {
+		t.Fatalf("NewFileLogWriter returned nil for an unwritable file")
+	}
+	fw.LogWrite(newLogRecord(ERROR, "src", "unwritable"))
+	fw.Close()
+	if got := strings.Join(lines, ""); !strings.Contains(got, "unwritable") {
+		t.Errorf("stderr %q, want the record", got)
+	}
+
+	// So does a socket which cannot be connected to, which is dialed again
+	// once the backoff is over
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	lines = nil
+	sw := NewSocketLogWriter("tcp", addr).SetFormatter(CompileFormat("%M")).SetRetryPolicy(RetryPolicy{Backoff: time.Millisecond})
+	l := NewLogger()
+	l.AddFilter("socket", DEBUG, sw)
+	l.Info("unconnected")
+	l.Flush(context.Background())
+	if got := strings.Join(lines, ""); !strings.Contains(got, "unconnected") {
+		t.Errorf("stderr %q, want the record", got)
+	}
+
+	if ln, err = net.Listen("tcp", addr); err != nil {
+		t.Skipf("listen again: %s", err)
+	}
+	defer ln.Close()
+	received := make(chan string)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		contents, _ := ioutil.ReadAll(conn)
+		received <- string(contents)
+	}()
+	time.Sleep(5 * time.Millisecond)
+	l.Info("connected")
+	l.Close()
+	if got := <-received; got != "connected\n" {
+		t.Errorf("after dialing again, received %q", got)
+	}
+}
+
 func TestSysLog(t *testing.T) {
 	w := NewSysLogWriter(LOCAL4)
 	if w == nil {
 		t.Fatalf("Invalid return: w should not be nil")
 	}
 
-	sl := make(Logger)
+	sl := NewLogger()
 	sl.AddFilter("stdout", DEBUG, w)
 	sl.Log(INFO, "TestSysLog", "This message is level INFO")
 	sl.Debug("This message is level %s", DEBUG)
@@ -191,33 +1393,47 @@ func TestXMLLogWriter(t *testing.T) {
 	} else if len(contents) != 190 {
 		t.Errorf("malformed xmllog: %q (%d bytes)", string(contents), len(contents))
 	}
+
+	// Restarting on the existing file appends without another header
+	w = NewXMLLogWriter(testLogFile, true)
+	w.LogWrite(newLogRecord(CRITICAL, "log4go_test", "again"))
+	w.Reopen()
+	w.LogWrite(newLogRecord(CRITICAL, "log4go_test", "reopened"))
+	w.Close()
+	contents, _ := ioutil.ReadFile(testLogFile)
+	if n := strings.Count(string(contents), "<log created="); n != 1 {
+		t.Errorf("%d headers in %q, want 1", n, contents)
+	}
+	if n := strings.Count(string(contents), "<record "); n != 3 {
+		t.Errorf("%d records in %q, want 3", n, contents)
+	}
 }
 
 func TestLogger(t *testing.T) {
 	sl := NewDefaultLogger(WARNING)
-	if sl == nil {
+	if sl.core == nil {
 		t.Fatalf("NewDefaultLogger should never return nil")
 	}
-	if lw, exist := sl["stdout"]; lw == nil || exist != true {
+	if lw, exist := sl.Filters()["stdout"]; lw == nil || exist != true {
 		t.Fatalf("NewDefaultLogger produced invalid logger (DNE or nil)")
 	}
-	if sl["stdout"].Level != WARNING {
+	if sl.Filters()["stdout"].Level != WARNING {
 		t.Fatalf("NewDefaultLogger produced invalid logger (incorrect level)")
 	}
-	if len(sl) != 1 {
+	if len(sl.Filters()) != 1 {
 		t.Fatalf("NewDefaultLogger produced invalid logger (incorrect map count)")
 	}
 
 	//func (l *Logger) AddFilter(name string, level int, writer LogWriter) {}
-	l := make(Logger)
+	l := NewLogger()
 	l.AddFilter("stdout", DEBUG, NewConsoleLogWriter())
-	if lw, exist := l["stdout"]; lw == nil || exist != true {
+	if lw, exist := l.Filters()["stdout"]; lw == nil || exist != true {
 		t.Fatalf("AddFilter produced invalid logger (DNE or nil)")
 	}
-	if l["stdout"].Level != DEBUG {
+	if l.Filters()["stdout"].Level != DEBUG {
 		t.Fatalf("AddFilter produced invalid logger (incorrect level)")
 	}
-	if len(l) != 1 {
+	if len(l.Filters()) != 1 {
 		t.Fatalf("AddFilter produced invalid logger (incorrect map count)")
 	}
 
@@ -247,6 +1463,373 @@ func TestLogger(t *testing.T) {
 	//func (l *Logger) Info(format string, args ...interface{}) {}
 }
 
+// recordingLogWriter keeps every record it is sent, for inspection by tests.
+type recordingLogWriter struct {
+	recs []*LogRecord
+}
+
+func (w *recordingLogWriter) LogWrite(rec *LogRecord) { w.recs = append(w.recs, rec) }
+func (w *recordingLogWriter) Close()                  {}
+
+func TestLoggerWith(t *testing.T) {
+	rw := new(recordingLogWriter)
+	l := NewLogger()
+	l.AddFilter("rec", DEBUG, rw)
+
+	req := l.With("request", 42)
+	req.With("user", "kevlar").Info("with both")
+	req.Info("with request")
+	l.Info("without")
+
+	want := []string{"request=42 user=kevlar", "request=42", ""}
+	if len(rw.recs) != len(want) {
+		t.Fatalf("got %d records, want %d", len(rw.recs), len(want))
+	}
+	for i, rec := range rw.recs {
+		if got := rec.Fields.String(); got != want[i] {
+			t.Errorf("record %d (%q): fields %q, want %q", i, rec.Message, got, want[i])
+		}
+	}
+
+	js, err := json.Marshal(rw.recs[0])
+	if err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+	if got, want := string(js), `"Fields":{"request":42,"user":"kevlar"}`; !strings.Contains(got, want) {
+		t.Errorf("json: got %s, want it to contain %s", got, want)
+	}
+}
+
+func TestSyslogStructuredData(t *testing.T) {
+	if got, want := syslogStructuredData(nil), "-"; got != want {
+		t.Errorf("empty: got %q, want %q", got, want)
+	}
+	got := syslogStructuredData(Fields{{"user id", `a"b]c\`}, {"n", 1}})
+	if want := `[` + SysLogSDID + ` user_id="a\"b\]c\\" n="1"]`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLoggerSourceInfo(t *testing.T) {
+	rw := new(recordingLogWriter)
+	l := NewLogger()
+	l.AddFilter("rec", DEBUG, rw)
+	l.Info("where")
+
+	rec := rw.recs[0]
+	if filepath.Base(rec.File) != "log4go_test.go" || rec.Line == 0 {
+		t.Errorf("got file %q line %d, want this file", rec.File, rec.Line)
+	}
+	if got, want := FormatLogRecord("%F", rec), fmt.Sprintf("log4go_test.go:%d\n", rec.Line); got != want {
+		t.Errorf("%%F: got %q, want %q", got, want)
+	}
+
+	// The goroutine id is only worked out when a format uses it
+	if rec.Goroutine != 0 {
+		t.Errorf("goroutine id %d recorded with no format using it", rec.Goroutine)
+	}
+	var buf bytes.Buffer
+	l.AddFilter("goroutine", DEBUG, NewFormatLogWriter(&buf, "%G"))
+	l.Info("which")
+	l.Close()
+	if rw.recs[1].Goroutine == 0 || buf.String() != fmt.Sprintf("%d\n", rw.recs[1].Goroutine) {
+		t.Errorf("goroutine id was not recorded: %d, formatted %q", rw.recs[1].Goroutine, buf.String())
+	}
+}
+
+func TestLoggerPrefix(t *testing.T) {
+	plain, a, b := new(recordingLogWriter), new(recordingLogWriter), new(recordingLogWriter)
+	l := NewLogger()
+	l.AddFilter("plain", DEBUG, plain)
+	l.AddFilter("a", DEBUG, a)
+	l.AddFilter("b", DEBUG, b)
+	l.SetPrefix("a", "pa")
+	l.SetPrefix("b", "pb")
+
+	l.Log(INFO, "src", "log")
+	l.Logf(INFO, "logf")
+	l.Logc(INFO, func() string { return "logc" })
+	l.Info("info")
+	l.Error("error")
+
+	for _, test := range []struct {
+		w      *recordingLogWriter
+		prefix string
+	}{{plain, ""}, {a, "pa"}, {b, "pb"}} {
+		if len(test.w.recs) != 5 {
+			t.Fatalf("prefix %q: got %d records, want 5", test.prefix, len(test.w.recs))
+		}
+		for _, rec := range test.w.recs {
+			if rec.Prefix != test.prefix {
+				t.Errorf("%q: got prefix %q, want %q", rec.Message, rec.Prefix, test.prefix)
+			}
+		}
+	}
+}
+
+func TestLoggerConcurrentFilters(t *testing.T) {
+	l := NewLogger()
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for j := 0; j < 1000; j++ {
+				l.Info("message %d", j)
+			}
+			done <- true
+		}()
+	}
+	for j := 0; j < 100; j++ {
+		name := fmt.Sprintf("rec%d", j%3)
+		l.AddFilter(name, DEBUG, new(countingLogWriter))
+		l.SetLevel(name, WARNING)
+		l.RemoveFilter(name)
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+	l.Close()
+	if n := len(l.Filters()); n != 0 {
+		t.Errorf("Close left %d filters", n)
+	}
+
+	// Many more changes while logging, none of which may hang
+	l = NewLogger()
+	stop := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					done <- true
+					return
+				default:
+					l.Info("message")
+				}
+			}
+		}()
+	}
+	changed := make(chan bool)
+	go func() {
+		for j := 0; j < 5000; j++ {
+			name := fmt.Sprintf("rec%d", j%3)
+			l.AddFilter(name, DEBUG, new(countingLogWriter))
+			l.SetLevel(name, WARNING)
+			l.ReplaceFilter(name, DEBUG, new(countingLogWriter))
+			l.RemoveFilter(name)
+		}
+		close(changed)
+	}()
+	select {
+	case <-changed:
+	case <-time.After(30 * time.Second):
+		t.Fatalf("changing filters while logging hung")
+	}
+	close(stop)
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+	l.Close()
+}
+
+func TestLoggerRemoveReplaceFilter(t *testing.T) {
+	var first, second, other bytes.Buffer
+	l := NewLogger()
+	l.AddFilter("swap", DEBUG, NewFormatLogWriter(&first, "%M"))
+	l.AddFilter("other", DEBUG, NewFormatLogWriter(&other, "%M"))
+
+	for i := 0; i < 10; i++ {
+		l.Info("a%d", i)
+	}
+	l.ReplaceFilter("swap", DEBUG, NewFormatLogWriter(&second, "%M"))
+	if got, want := first.String(), "a0\na1\na2\na3\na4\na5\na6\na7\na8\na9\n"; got != want {
+		t.Errorf("replaced writer was not drained: got %q, want %q", got, want)
+	}
+
+	l.Info("b")
+	l.RemoveFilter("swap")
+	if got, want := second.String(), "b\n"; got != want {
+		t.Errorf("removed writer was not drained: got %q, want %q", got, want)
+	}
+	if _, ok := l.Filters()["other"]; !ok || len(l.Filters()) != 1 {
+		t.Errorf("RemoveFilter affected other filters: %v", l.Filters())
+	}
+
+	l.Close()
+	if got := strings.Count(other.String(), "\n"); got != 11 {
+		t.Errorf("other writer got %d records, want 11", got)
+	}
+}
+
+func TestLoggerSetLevelWhileBlocked(t *testing.T) {
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	LogBufferLength = 0
+
+	out := &gateWriter{started: make(chan bool, 1), gate: make(chan bool)}
+	l := NewLogger()
+	l.AddFilter("stuck", DEBUG, NewFormatLogWriter(out, "%M"))
+	l.Info("first")
+	<-out.started
+	blocked := make(chan bool)
+	go func() {
+		l.Info("second") // blocks until the writer is let go
+		close(blocked)
+	}()
+	time.Sleep(10 * time.Millisecond) // for it to block
+
+	changed := make(chan bool)
+	go func() {
+		l.SetLevel("stuck", INFO)
+		l.AddFilter("more", DEBUG, new(recordingLogWriter))
+		close(changed)
+	}()
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Errorf("SetLevel waited for a blocked writer")
+	}
+
+	close(out.gate)
+	<-blocked
+	l.Close()
+}
+
+func TestLoggerRemoveFilterWhileBlocked(t *testing.T) {
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	LogBufferLength = 0
+
+	out := &gateWriter{started: make(chan bool, 1), gate: make(chan bool)}
+	l := NewLogger()
+	l.AddFilter("stuck", DEBUG, NewFormatLogWriter(out, "%M"))
+	l.Info("first")
+	<-out.started
+	blocked := make(chan bool)
+	go func() {
+		l.Info("second") // blocks until the writer is let go
+		close(blocked)
+	}()
+	time.Sleep(10 * time.Millisecond) // for it to block
+
+	// The writer is removed from a later set than the one still being
+	// written through, and must not be closed until that is done
+	removed := make(chan bool)
+	go func() {
+		l.SetLevel("stuck", INFO)
+		l.RemoveFilter("stuck")
+		close(removed)
+	}()
+	select {
+	case <-removed:
+		t.Errorf("RemoveFilter closed a writer which was still being written to")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(out.gate)
+	<-blocked
+	<-removed
+	if got, want := out.buf.String(), "first\nsecond\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	l.Close()
+}
+
+// countingLogWriter counts the records it is sent and panics if it is written
+// to after being closed.
+type countingLogWriter struct {
+	n      int64
+	closed int32
+}
+
+func (w *countingLogWriter) LogWrite(rec *LogRecord) {
+	if atomic.LoadInt32(&w.closed) != 0 {
+		panic("LogWrite after Close")
+	}
+	atomic.AddInt64(&w.n, 1)
+}
+
+func (w *countingLogWriter) Close() { atomic.StoreInt32(&w.closed, 1) }
+
+func TestCompiledFormatLocation(t *testing.T) {
+	rec := &LogRecord{Level: INFO, Message: "message", Created: now}
+	formats := []struct {
+		Format *CompiledFormat
+		Want   string
+	}{
+		{CompileFormat("%D %T %M"), "2009/02/13 23:31:30 UTC message\n"},
+		{CompileFormat("%D %T %M").SetLocation(time.UTC), "2009/02/13 23:31:30 UTC message\n"},
+		{CompileFormat("%D %T %M").SetLocation(time.FixedZone("JST", 9*60*60)), "2009/02/14 08:31:30 JST message\n"},
+		{CompileFormat("%d %t %{-0700}T").SetLocation(time.FixedZone("PST", -8*60*60)), "02/13/09 15:31 -0800\n"},
+	}
+
+	// Format from several goroutines at once, with records from different
+	// seconds, to make sure each format keeps its own cache
+	done := make(chan bool)
+	for g := 0; g < 4; g++ {
+		go func(g int) {
+			defer func() { done <- true }()
+			for i := 0; i < 100; i++ {
+				rec := *rec
+				rec.Created = rec.Created.Add(time.Duration(g*i%2) * time.Hour)
+				for _, f := range formats {
+					f.Format.Format(nil, &rec)
+				}
+			}
+		}(g)
+	}
+	for g := 0; g < 4; g++ {
+		<-done
+	}
+
+	for _, f := range formats {
+		if got := string(f.Format.Format(nil, rec)); got != f.Want {
+			t.Errorf("%q: got %q, want %q", f.Format, got, f.Want)
+		}
+	}
+
+	json := JSONFormatter{Location: time.FixedZone("JST", 9*60*60)}
+	if got, want := string(json.Format(nil, rec)), `{"ts":"2009-02-14T08:31:30+09:00",`; !strings.HasPrefix(got, want) {
+		t.Errorf("JSONFormatter with Location: got %q, want prefix %q", got, want)
+	}
+}
+
+func TestLoadConfigurationFormat(t *testing.T) {
+	const config = "_logtest.xml"
+	err := ioutil.WriteFile(config, []byte(`<logging>
+  <filter enabled="true">
+    <tag>file</tag>
+    <type>file</type>
+    <level>INFO</level>
+    <property name="filename">`+testLogFile+`</property>
+    <property name="format">logfmt</property>
+    <property name="timezone">UTC</property>
+  </filter>
+</logging>`), 0644)
+	if err != nil {
+		t.Fatalf("write(%q): %s", config, err)
+	}
+	defer os.Remove(config)
+	defer os.Remove(testLogFile)
+
+	l := NewLogger()
+	l.LoadConfiguration(config)
+	if filt, ok := l.Filters()["file"]; !ok || filt.Level != INFO {
+		t.Fatalf("LoadConfiguration did not add the file filter: %v", l.Filters())
+	}
+	l.Log(INFO, "src", "configured")
+	l.Close()
+
+	contents, err := ioutil.ReadFile(testLogFile)
+	if err != nil {
+		t.Fatalf("read(%q): %s", testLogFile, err)
+	}
+	if got := string(contents); !strings.Contains(got, "Z level=info src=src msg=configured\n") {
+		t.Errorf("file does not contain logfmt output: %q", got)
+	}
+}
+
 func TestLogOutput(t *testing.T) {
 	const (
 		expected = "85895942723382e03f559e8ddc12da20"
@@ -258,7 +1841,7 @@ func TestLogOutput(t *testing.T) {
 	}(LogBufferLength)
 	LogBufferLength = 0
 
-	l := make(Logger)
+	l := NewLogger()
 
 	// Delete and open the output log without a timestamp (for a constant md5sum)
 	l.AddFilter("file", DEBUG, NewFileLogWriter(testLogFile, false).SetFormat("[%L] %M"))
@@ -306,6 +1889,37 @@ func TestCountMallocs(t *testing.T) {
 	for i := 0; i < N; i++ {
 		sl.Logf(DEBUG, "%s is a log message with level %s", "This", DEBUG)
 	}
+
+	// Formatting into a reused buffer should not allocate
+	rec := &LogRecord{
+		Level:     CRITICAL,
+		Created:   now,
+		Source:    "log4go_test",
+		Message:   "message",
+		File:      "/src/log4go_test.go",
+		Line:      12,
+		Goroutine: 7,
+		Fields:    Fields{{"user", "kevlar"}},
+	}
+	for _, format := range []string{FORMAT_DEFAULT, FORMAT_SHORT, "%D %T.%u %-8V %F %G %P %H [%.5p] %M %X"} {
+		compiled := CompileFormat(format)
+		buf := compiled.Format(nil, rec)
+		if allocs := testing.AllocsPerRun(100, func() {
+			buf = compiled.Format(buf[:0], rec)
+		}); allocs != 0 {
+			t.Errorf("CompiledFormat(%q).Format: %v allocations per record, want 0", format, allocs)
+		}
+	}
+
+	// Writers format straight into their own buffer
+	w := NewFormatLogWriter(ioutil.Discard, FORMAT_DEFAULT)
+	defer w.Close()
+	if allocs := testing.AllocsPerRun(100, func() {
+		w.LogWrite(rec)
+		w.Flush(context.Background())
+	}); allocs > 6 {
+		t.Errorf("FormatLogWriter: %v allocations per record, want at most 6", allocs)
+	}
 }
 
 func BenchmarkFormatLogRecord(b *testing.B) {
@@ -327,6 +1941,37 @@ func BenchmarkFormatLogRecord(b *testing.B) {
 	}
 }
 
+func BenchmarkCompiledFormat(b *testing.B) {
+	rec := &LogRecord{
+		Level:   CRITICAL,
+		Created: now,
+		Source:  "log4go_test",
+		Message: "message",
+	}
+	compiled := CompileFormat(FORMAT_DEFAULT)
+	var buf []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = compiled.Format(buf[:0], rec)
+	}
+}
+
+func BenchmarkFormatLogWriter(b *testing.B) {
+	w := NewFormatLogWriter(ioutil.Discard, FORMAT_DEFAULT)
+	defer w.Close()
+	rec := &LogRecord{
+		Level:   CRITICAL,
+		Created: now,
+		Source:  "log4go_test",
+		Message: "message",
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.LogWrite(rec)
+	}
+	w.Flush(context.Background())
+}
+
 func BenchmarkConsoleLog(b *testing.B) {
 	/*
 	sink, err := os.Open(os.DevNull)
@@ -371,7 +2016,7 @@ func BenchmarkConsoleUtilNotLog(b *testing.B) {
 }
 
 func BenchmarkFileLog(b *testing.B) {
-	sl := make(Logger)
+	sl := NewLogger()
 	b.StopTimer()
 	sl.AddFilter("file", INFO, NewFileLogWriter("benchlog.log", false))
 	b.StartTimer()
@@ -383,7 +2028,7 @@ func BenchmarkFileLog(b *testing.B) {
 }
 
 func BenchmarkFileNotLogged(b *testing.B) {
-	sl := make(Logger)
+	sl := NewLogger()
 	b.StopTimer()
 	sl.AddFilter("file", INFO, NewFileLogWriter("benchlog.log", false))
 	b.StartTimer()
@@ -395,7 +2040,7 @@ func BenchmarkFileNotLogged(b *testing.B) {
 }
 
 func BenchmarkFileUtilLog(b *testing.B) {
-	sl := make(Logger)
+	sl := NewLogger()
 	b.StopTimer()
 	sl.AddFilter("file", INFO, NewFileLogWriter("benchlog.log", false))
 	b.StartTimer()
@@ -407,7 +2052,7 @@ func BenchmarkFileUtilLog(b *testing.B) {
 }
 
 func BenchmarkFileUtilNotLog(b *testing.B) {
-	sl := make(Logger)
+	sl := NewLogger()
 	b.StopTimer()
 	sl.AddFilter("file", INFO, NewFileLogWriter("benchlog.log", false))
 	b.StartTimer()
@@ -3,6 +3,7 @@
 package log4go
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -27,22 +28,67 @@ func AddFilter(name string, lvl LogLevel, writer LogWriter) {
 	Global.AddFilter(name, lvl, writer)
 }
 
+// Wrapper for (*Logger).RemoveFilter
+func RemoveFilter(name string) {
+	Global.RemoveFilter(name)
+}
+
+// Wrapper for (*Logger).ReplaceFilter
+func ReplaceFilter(name string, lvl LogLevel, writer LogWriter) {
+	Global.ReplaceFilter(name, lvl, writer)
+}
+
+// Wrapper for (*Logger).SetLevel
+func SetLevel(name string, lvl LogLevel) {
+	Global.SetLevel(name, lvl)
+}
+
+// Wrapper for (*Logger).SetPrefix
+func SetPrefix(name string, prefix string) {
+	Global.SetPrefix(name, prefix)
+}
+
+// Wrapper for (*Logger).With
+func With(keyvals ...interface{}) Logger {
+	return Global.With(keyvals...)
+}
+
 // Wrapper for (*Logger).Close (closes and removes all logwriters)
 func Close() {
 	Global.Close()
 }
 
+// Wrapper for (*Logger).Flush
+func Flush(ctx context.Context) error {
+	return Global.Flush(ctx)
+}
+
+// Wrapper for (*Logger).Shutdown
+func Shutdown(ctx context.Context) error {
+	return Global.Shutdown(ctx)
+}
+
+// shutdownForExit shuts down the global logger, waiting at most ExitTimeout
+// for the pending messages to be written.
+func shutdownForExit() {
+	ctx, cancel := context.WithTimeout(context.Background(), ExitTimeout)
+	defer cancel()
+	Global.Shutdown(ctx)
+}
+
+// Logs the given arguments and crashes the program
 func Crash(args ...interface{}) {
 	if len(args) > 0 {
 		Global.intLogf(CRITICAL, strings.Repeat(" %v", len(args))[1:], args...)
 	}
+	shutdownForExit()
 	panic(args)
 }
 
 // Logs the given message and crashes the program
 func Crashf(format string, args ...interface{}) {
 	Global.intLogf(CRITICAL, format, args...)
-	Global.Close() // so that hopefully the messages get logged
+	shutdownForExit()
 	panic(fmt.Sprintf(format, args...))
 }
 
@@ -51,14 +97,14 @@ func Exit(args ...interface{}) {
 	if len(args) > 0 {
 		Global.intLogf(ERROR, strings.Repeat(" %v", len(args))[1:], args...)
 	}
-	Global.Close() // so that hopefully the messages get logged
+	shutdownForExit()
 	os.Exit(0)
 }
 
 // Compatibility with `log`
 func Exitf(format string, args ...interface{}) {
 	Global.intLogf(ERROR, format, args...)
-	Global.Close() // so that hopefully the messages get logged
+	shutdownForExit()
 	os.Exit(0)
 }
 